@@ -0,0 +1,53 @@
+package blobstore
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNotExist is returned (or wrapped) by Open and Stat when a blob does not exist.
+// Use errors.Is(err, blobstore.ErrNotExist) to check for missing blobs.
+var ErrNotExist = os.ErrNotExist
+
+// BlobStore stores the cached values (blobs).  Blobs are identified by bucket and key.
+// The cache index (i.e. the sqlite database) is kept separately, so a BlobStore only needs to store bytes.
+type BlobStore interface {
+	// Create streams the contents of r to a blob, and returns the number of bytes written.
+	// An existing blob is replaced atomically, and is left unchanged if Create fails.
+	// Create returns io.ErrShortWrite if fewer than size bytes are read from r.
+	Create(bucket, key string, r io.Reader, size int64) (n int64, err error)
+	// Open opens a blob for reading
+	Open(bucket, key string) (Blob, error)
+	// Remove removes a blob.  It is not an error to remove a blob that does not exist.
+	Remove(bucket, key string) error
+	// Stat returns information about a blob
+	Stat(bucket, key string) (Info, error)
+	// List calls fn for each blob in the store
+	List(fn func(Info) error) error
+	// RemoveBucket removes all of the blobs in a bucket
+	RemoveBucket(bucket string) error
+}
+
+// Blob is an open blob
+type Blob interface {
+	io.ReadCloser
+	io.ReaderAt
+	io.Seeker
+}
+
+// Info is information about a blob
+type Info struct {
+	// Bucket and Key are the bucket and key of the blob.
+	// They are empty if they cannot be determined from the stored blob (e.g. an unknown file in a file cache).
+	Bucket string
+	Key    string
+	// KeyHash is the hash of the key (see cacheitem.KeyHash) if the blob is stored by key hash, and the key is not known
+	KeyHash string
+	// Name is the name of the blob in the store (e.g. the file path or object key)
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Temp is true if the blob is a temporary blob left behind by an interrupted Create.  Temporary blobs can be safely removed.
+	Temp bool
+}
@@ -0,0 +1,139 @@
+package blobstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory BlobStore.  It is intended for tests.
+type Memory struct {
+	sync.RWMutex
+	blobs map[memoryName]memoryBlob
+}
+
+type memoryName struct {
+	bucket string
+	key    string
+}
+
+type memoryBlob struct {
+	b       []byte
+	modTime time.Time
+}
+
+// NewMemory returns a new in-memory BlobStore
+func NewMemory() *Memory {
+	return &Memory{
+		blobs: make(map[memoryName]memoryBlob),
+	}
+}
+
+// Create streams the contents of r to a blob
+func (m *Memory) Create(bucket, key string, r io.Reader, size int64) (n int64, err error) {
+	var buf bytes.Buffer
+	n, err = io.Copy(&buf, r)
+	if err != nil {
+		return n, err
+	}
+	if n < size {
+		return n, io.ErrShortWrite
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.blobs[memoryName{bucket, key}] = memoryBlob{buf.Bytes(), time.Now()}
+	return n, nil
+}
+
+// Open opens a blob for reading
+func (m *Memory) Open(bucket, key string) (Blob, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	blob, ok := m.blobs[memoryName{bucket, key}]
+	if !ok {
+		return nil, fmt.Errorf("memory blob %s %s: %w", bucket, key, ErrNotExist)
+	}
+	return memoryReader{bytes.NewReader(blob.b)}, nil
+}
+
+// Remove removes a blob
+func (m *Memory) Remove(bucket, key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.blobs, memoryName{bucket, key})
+	return nil
+}
+
+// Stat returns information about a blob
+func (m *Memory) Stat(bucket, key string) (Info, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	name := memoryName{bucket, key}
+	blob, ok := m.blobs[name]
+	if !ok {
+		return Info{}, fmt.Errorf("memory blob %s %s: %w", bucket, key, ErrNotExist)
+	}
+	return m.info(name, blob), nil
+}
+
+// List calls fn for each blob in the store, in bucket and key order
+func (m *Memory) List(fn func(Info) error) error {
+	m.RLock()
+	infos := make([]Info, 0, len(m.blobs))
+	for name, blob := range m.blobs {
+		infos = append(infos, m.info(name, blob))
+	}
+	m.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	for _, info := range infos {
+		err := fn(info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveBucket removes all of the blobs in a bucket
+func (m *Memory) RemoveBucket(bucket string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for name := range m.blobs {
+		if name.bucket == bucket {
+			delete(m.blobs, name)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) info(name memoryName, blob memoryBlob) Info {
+	return Info{
+		Bucket:  name.bucket,
+		Key:     name.key,
+		Name:    name.bucket + "/" + name.key,
+		Size:    int64(len(blob.b)),
+		ModTime: blob.modTime,
+	}
+}
+
+// memoryReader is an open memory blob
+type memoryReader struct {
+	*bytes.Reader
+}
+
+// Close closes the blob
+func (r memoryReader) Close() error {
+	return nil
+}
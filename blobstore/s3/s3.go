@@ -0,0 +1,370 @@
+// Package s3 is a blobstore.BlobStore that stores blobs in an S3 compatible object store.
+// Requests are signed using AWS Signature Version 4, and path style URLs are used so that
+// the store works with S3 compatible servers (e.g. MinIO) as well as AWS S3.
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imclaren/calmcache/blobstore"
+)
+
+// Store implements blobstore.BlobStore
+var _ blobstore.BlobStore = (*Store)(nil)
+
+// Config is the S3 store configuration
+type Config struct {
+	// Endpoint is the URL of the S3 server (e.g. "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000")
+	Endpoint string
+	// Region is the S3 region.  The default is "us-east-1".
+	Region string
+	// Bucket is the S3 bucket that the blobs are stored in.  Note that this is not a cache bucket.
+	Bucket string
+	// Prefix is added to the start of all object keys
+	Prefix string
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials used to sign requests.
+	// Requests are not signed if AccessKeyID is empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client is the http.Client used for requests.  The default is http.DefaultClient.
+	Client *http.Client
+}
+
+// Store is an S3 blob store.  Blobs are stored as objects with the key Prefix + bucket + "/" + key.
+type Store struct {
+	cfg      Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// New returns a new S3 blob store
+func New(cfg Config) (*Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 store error: empty bucket provided")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 store endpoint error: %s %v", cfg.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 store endpoint error: %s", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   client,
+	}, nil
+}
+
+// Create streams the contents of r to an object.  S3 puts are atomic, so an existing object is replaced atomically.
+func (s *Store) Create(bucket, key string, r io.Reader, size int64) (n int64, err error) {
+	cr := &countingReader{r: r}
+	var body io.Reader = cr
+	if size == 0 {
+		body = http.NoBody
+	}
+	resp, err := s.do(http.MethodPut, s.objectKey(bucket, key), nil, nil, body, size)
+	if err != nil {
+		return cr.n, err
+	}
+	resp.Body.Close()
+	if cr.n < size {
+		return cr.n, io.ErrShortWrite
+	}
+	return cr.n, nil
+}
+
+// Open opens an object for reading.  The object is read using range requests.
+func (s *Store) Open(bucket, key string) (blobstore.Blob, error) {
+	info, err := s.Stat(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &object{
+		s:    s,
+		key:  info.Name,
+		size: info.Size,
+	}, nil
+}
+
+// Remove removes an object
+func (s *Store) Remove(bucket, key string) error {
+	resp, err := s.do(http.MethodDelete, s.objectKey(bucket, key), nil, nil, nil, 0)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stat returns information about an object
+func (s *Store) Stat(bucket, key string) (blobstore.Info, error) {
+	objectKey := s.objectKey(bucket, key)
+	resp, err := s.do(http.MethodHead, objectKey, nil, nil, nil, 0)
+	if err != nil {
+		return blobstore.Info{}, err
+	}
+	resp.Body.Close()
+	info := s.info(objectKey, resp.ContentLength, time.Time{})
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+// List calls fn for each object with the store prefix
+func (s *Store) List(fn func(blobstore.Info) error) error {
+	return s.list(s.cfg.Prefix, fn)
+}
+
+// RemoveBucket removes all of the objects in a cache bucket
+func (s *Store) RemoveBucket(bucket string) error {
+	return s.list(s.cfg.Prefix+bucket+"/", func(info blobstore.Info) error {
+		return s.Remove(info.Bucket, info.Key)
+	})
+}
+
+// listBucketResult is the ListObjectsV2 response
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+func (s *Store) list(prefix string, fn func(blobstore.Info) error) error {
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list decode error: %v", err)
+		}
+		for _, c := range result.Contents {
+			err = fn(s.info(c.Key, c.Size, c.LastModified))
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *Store) objectKey(bucket, key string) string {
+	return s.cfg.Prefix + bucket + "/" + key
+}
+
+// info returns the blob information for an object.  The bucket and key are derived from the object key.
+func (s *Store) info(objectKey string, size int64, modTime time.Time) blobstore.Info {
+	info := blobstore.Info{
+		Name:    objectKey,
+		Size:    size,
+		ModTime: modTime,
+	}
+	if !strings.HasPrefix(objectKey, s.cfg.Prefix) {
+		return info
+	}
+	parts := strings.SplitN(strings.TrimPrefix(objectKey, s.cfg.Prefix), "/", 2)
+	if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		info.Bucket = parts[0]
+		info.Key = parts[1]
+	}
+	return info
+}
+
+// do sends a signed request for an object (or the S3 bucket if objectKey is empty), and returns an error for unsuccessful responses
+func (s *Store) do(method, objectKey string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.cfg.Bucket
+	u.RawPath = "/" + escape(s.cfg.Bucket, false)
+	if objectKey != "" {
+		u.Path += "/" + objectKey
+		u.RawPath += "/" + escape(objectKey, true)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && body != http.NoBody {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s error: %v", method, objectKey, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		err = fmt.Errorf("s3 %s %s error: %s", method, objectKey, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &notExistError{err}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// notExistError is returned for 404 responses, and wraps blobstore.ErrNotExist
+type notExistError struct {
+	err error
+}
+
+func (e *notExistError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notExistError) Unwrap() error {
+	return blobstore.ErrNotExist
+}
+
+func isNotExist(err error) bool {
+	_, ok := err.(*notExistError)
+	return ok
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// object is an open S3 object
+type object struct {
+	s    *Store
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+// Read reads from the current offset.  The object body is requested from the current offset on the first Read after Open or Seek.
+func (o *object) Read(p []byte) (n int, err error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(o.off, 10) + "-"}}
+		resp, err := o.s.do(http.MethodGet, o.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err = o.body.Read(p)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from offset off using a range request
+func (o *object) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("s3 object ReadAt error: negative offset")
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > o.size {
+		end = o.size
+	}
+	if end == off {
+		return 0, nil
+	}
+	header := http.Header{"Range": {"bytes=" + strconv.FormatInt(off, 10) + "-" + strconv.FormatInt(end-1, 10)}}
+	resp, err := o.s.do(http.MethodGet, o.key, nil, header, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err = io.ReadFull(resp.Body, p[:end-off])
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Seek sets the offset for the next Read
+func (o *object) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = o.off + offset
+	case io.SeekEnd:
+		off = o.size + offset
+	default:
+		return 0, fmt.Errorf("s3 object Seek error: invalid whence")
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("s3 object Seek error: negative position")
+	}
+	if off != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.off = off
+	return off, nil
+}
+
+// Close closes the object body
+func (o *object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,234 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imclaren/calmcache/blobstore"
+	assert "github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal S3 compatible server that supports the requests used by Store.
+// It checks request signatures using the Store that is under test.
+type fakeS3 struct {
+	sync.Mutex
+	t       *testing.T
+	s       *Store
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	// Check the request signature
+	amzDate := r.Header.Get("x-amz-date")
+	if amzDate == "" || r.Header.Get("Authorization") != f.s.authorization(r, amzDate) {
+		http.Error(w, "signature does not match", http.StatusForbidden)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if rest == "" || rest == "/" {
+		f.list(w, r)
+		return
+	}
+	key := strings.TrimPrefix(rest, "/")
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+	case http.MethodHead, http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		status := http.StatusOK
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			parts := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+			start, _ := strconv.Atoi(parts[0])
+			end := len(b) - 1
+			if parts[1] != "" {
+				end, _ = strconv.Atoi(parts[1])
+			}
+			b = b[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the objects with the request prefix, two objects per page
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// The continuation token is the last key returned, so that objects can be deleted between pages
+	start := 0
+	if token := r.URL.Query().Get("continuation-token"); token != "" {
+		start = sort.SearchStrings(keys, token)
+		if start < len(keys) && keys[start] == token {
+			start++
+		}
+	}
+	var result listBucketResult
+	for i := start; i < len(keys) && i < start+2; i++ {
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{keys[i], int64(len(f.objects[keys[i]])), time.Now().UTC()})
+	}
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[start+1]
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	f := &fakeS3{
+		t:       t,
+		bucket:  "calmcache",
+		objects: map[string][]byte{},
+	}
+	server := httptest.NewServer(f)
+	s, err := New(Config{
+		Endpoint:        server.URL,
+		Bucket:          "calmcache",
+		Prefix:          "cache/",
+		AccessKeyID:     "test",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.s = s
+	return s, server.Close
+}
+
+func TestStore(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	testCases := []struct {
+		bucket string
+		key    string
+		value  []byte
+	}{
+		{"bucket1", "testkey", []byte("123")},
+		{"bucket1", "test key/with+special=chars&", []byte("456789")},
+		{"bucket1", "empty", []byte("")},
+		{"bucket2", "testkey", []byte("abc")},
+	}
+	for _, testCase := range testCases {
+		n, err := s.Create(testCase.bucket, testCase.key, bytes.NewReader(testCase.value), int64(len(testCase.value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(len(testCase.value)), n)
+	}
+	for _, testCase := range testCases {
+		info, err := s.Stat(testCase.bucket, testCase.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(len(testCase.value)), info.Size)
+		blob, err := s.Open(testCase.bucket, testCase.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, testCase.value, b)
+		blob.Close()
+	}
+
+	// Range reads
+	blob, err := s.Open("bucket1", "test key/with+special=chars&")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 2)
+	n, err := blob.ReadAt(p, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "67", string(p[:n]))
+	_, err = blob.Seek(4, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "89", string(b))
+	blob.Close()
+
+	// List
+	names := []string{}
+	err = s.List(func(info blobstore.Info) error {
+		names = append(names, fmt.Sprintf("%s|%s", info.Bucket, info.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"bucket1|empty", "bucket1|test key/with+special=chars&", "bucket1|testkey", "bucket2|testkey"}, names)
+
+	// Remove
+	err = s.Remove("bucket2", "testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Stat("bucket2", "testkey")
+	assert.True(t, errors.Is(err, blobstore.ErrNotExist))
+	err = s.RemoveBucket("bucket1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = s.List(func(info blobstore.Info) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, count)
+}
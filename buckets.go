@@ -0,0 +1,145 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// BucketConfig is the configuration of a bucket.  It is stored in the database, so it is kept when the cache is reopened.
+// Zero values mean that there is no limit.
+type BucketConfig struct {
+	// MaxSize is the maximum total size (in bytes) of the items in the bucket, before they are compressed and encrypted
+	MaxSize int64
+	// MaxItems is the maximum number of items in the bucket
+	MaxItems int64
+	// DefaultTTL is the time to live of items that are put without a TTL
+	DefaultTTL time.Duration
+	// MaxItemSize is the maximum size (in bytes) of an item in the bucket
+	MaxItemSize int64
+	// Evict evicts items from the bucket to make room for a put that would exceed MaxSize or MaxItems, using the eviction policy of the bucket.
+	// Otherwise, the put is rejected with ErrQuotaExceeded.  Puts that exceed MaxItemSize are always rejected.
+	Evict bool
+}
+
+// SetBucketConfig sets the configuration of a bucket, and replaces any existing configuration.
+// Use the zero BucketConfig to remove the limits of a bucket.  Existing items are not pruned to the new limits (see PruneToSize).
+// Note that the configuration is kept when the bucket is deleted.
+func (c *Cache) SetBucketConfig(bucket string, cfg BucketConfig) error {
+	err := validBucket(bucket)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxSize < 0 || cfg.MaxItems < 0 || cfg.DefaultTTL < 0 || cfg.MaxItemSize < 0 {
+		return fmt.Errorf("cache SetBucketConfig error: %s negative limit", bucket)
+	}
+
+	unlock := c.lockBucket(bucket)
+	defer unlock()
+
+	err = c.checkOpen()
+	if err != nil {
+		return err
+	}
+	if cfg == (BucketConfig{}) {
+		return c.DB.DeleteBucketConfig(bucket)
+	}
+	return c.DB.SetBucketConfig(cacheitem.BucketConfig{
+		Bucket:      bucket,
+		MaxSize:     cfg.MaxSize,
+		MaxItems:    cfg.MaxItems,
+		DefaultTTL:  cfg.DefaultTTL,
+		MaxItemSize: cfg.MaxItemSize,
+		Evict:       cfg.Evict,
+	})
+}
+
+// GetBucketConfig gets the configuration of a bucket.  If the bucket has not been configured, OK returns false.
+func (c *Cache) GetBucketConfig(bucket string) (OK bool, cfg BucketConfig, err error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	err = c.checkOpen()
+	if err != nil {
+		return false, BucketConfig{}, err
+	}
+	b, err := c.DB.GetBucketConfig(bucket)
+	if err != nil || b == nil {
+		return false, BucketConfig{}, err
+	}
+	return true, BucketConfig{
+		MaxSize:     b.MaxSize,
+		MaxItems:    b.MaxItems,
+		DefaultTTL:  b.DefaultTTL,
+		MaxItemSize: b.MaxItemSize,
+		Evict:       b.Evict,
+	}, nil
+}
+
+// checkItemSize returns an error that wraps ErrQuotaExceeded if an item of size bytes is larger than the maximum item size of the bucket
+func checkItemSize(cfg *cacheitem.BucketConfig, size int64) error {
+	if cfg == nil || cfg.MaxItemSize <= 0 || size <= cfg.MaxItemSize {
+		return nil
+	}
+	return fmt.Errorf("%w: bucket %s item size %d is larger than the maximum item size %d", ErrQuotaExceeded, cfg.Bucket, size, cfg.MaxItemSize)
+}
+
+// makeBucketRoom makes room for a put of size bytes within the quotas of a bucket.  Replaced is the item that the put replaces, or nil.
+// If the bucket configuration does not allow eviction, the error wraps ErrQuotaExceeded.  Otherwise, items are evicted from the bucket
+// using the eviction policy of the bucket until the put fits.  Pinned items are not evicted.
+// Note that the item must be locked by the caller (see lockItem), and that concurrent puts may exceed the quotas.
+func (c *Cache) makeBucketRoom(ctx context.Context, cfg *cacheitem.BucketConfig, size int64, replaced *cacheitem.Item) error {
+	if cfg == nil {
+		return nil
+	}
+	err := checkItemSize(cfg, size)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxSize <= 0 && cfg.MaxItems <= 0 {
+		return nil
+	}
+	if cfg.MaxSize > 0 && size > cfg.MaxSize {
+		return fmt.Errorf("%w: bucket %s item size %d is larger than the maximum bucket size %d", ErrQuotaExceeded, cfg.Bucket, size, cfg.MaxSize)
+	}
+	var count int64 = 1
+	if replaced != nil {
+		size -= replaced.Size
+		count = 0
+	}
+	orderBy, args := c.evictionPolicy(cfg.Bucket).Order(time.Now())
+	skip := 0
+	for {
+		s, err := c.DB.BucketStatsContext(ctx, cfg.Bucket)
+		if err != nil {
+			return err
+		}
+		overSize := cfg.MaxSize > 0 && s.Size+size > cfg.MaxSize
+		overItems := cfg.MaxItems > 0 && s.Count+count > cfg.MaxItems
+		if !overSize && !overItems {
+			return nil
+		}
+		if !cfg.Evict {
+			return fmt.Errorf("%w: bucket %s maximum size %d, maximum items %d", ErrQuotaExceeded, cfg.Bucket, cfg.MaxSize, cfg.MaxItems)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		i, err := c.DB.GetFirstInBucketSkippingContext(ctx, cfg.Bucket, orderBy, args, skip)
+		if err != nil {
+			return err
+		}
+		if i == nil {
+			return fmt.Errorf("%w: bucket %s no items can be evicted", ErrQuotaExceeded, cfg.Bucket)
+		}
+		OK, err := c.deleteUnpinned(ctx, i.Bucket, i.Key)
+		if err != nil {
+			return fmt.Errorf("cache evict error: %s %s %w", i.Bucket, i.Key, err)
+		}
+		if !OK {
+			skip++
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package cacheitem
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 )
 
@@ -12,6 +14,18 @@ type Item struct {
 	Size 			int64 		`db:"size"`
 	AccessCount 	int64  		`db:"access_count"`
 	ExpiresAt 		time.Time  	`db:"expires_at"`
+	Version 		int64  		`db:"version"`
+	Checksum 		string  	`db:"checksum"`
+	Blob 			string  	`db:"blob"`
+	Codec 			string  	`db:"codec"`
+	StoredSize 		int64  		`db:"stored_size"`
+	KeyID 			string  	`db:"key_id"`
+	KeyHash 		string  	`db:"key_hash"`
+	ContentType 		string  	`db:"content_type"`
+	ContentEncoding 	string  	`db:"content_encoding"`
+	ETag 			string  	`db:"etag"`
+	Metadata 		string  	`db:"metadata"`
+	Tags 			[]string 	`db:"-"`
 	CreatedAt       time.Time 	`db:"created_at"`
 	UpdatedAt       time.Time 	`db:"updated_at"`
 }
@@ -22,10 +36,62 @@ func New(bucket, key string, size, accessCount int64, expiresAt time.Time) Item
 		//Id              int
 		Bucket: 		bucket,
 		Key: 			key,
+		KeyHash: 		KeyHash(key),
 		Size: 			size,
+		StoredSize: 	size,
 		AccessCount: 	accessCount,
 		ExpiresAt: 		expiresAt,
+		Version: 		1,
 		//CreatedAt       time.Time 	`db:"created_at"`
 		//UpdatedAt       time.Time 	`db:"updated_at"`
 	}
+}
+// Expired returns true if the item has an expiry time and that time has passed
+func (i Item) Expired() bool {
+	return !i.ExpiresAt.IsZero() && time.Now().After(i.ExpiresAt)
+}
+
+// ExpiresAt returns the expiry time for a time to live (ttl) starting now.
+// A ttl that is zero or negative means that the item does not expire.
+func ExpiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl).UTC()
+}
+
+// KeyHash returns the hex encoded SHA-256 hash of a key
+func KeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Encoded returns true if the stored value of the item is encoded (i.e. compressed or encrypted)
+func (i Item) Encoded() bool {
+	return i.Codec != "" || i.KeyID != ""
+}
+
+// Stats are the number, total size and total stored size of the items in a bucket or in the cache
+type Stats struct {
+	Count      int64 `db:"item_count"`
+	Size       int64 `db:"size"`
+	StoredSize int64 `db:"stored_size"`
+}
+
+// BucketConfig is the persisted configuration of a bucket.  Zero values mean that there is no limit.
+type BucketConfig struct {
+	Bucket      string        `db:"bucket"`
+	MaxSize     int64         `db:"max_size"`
+	MaxItems    int64         `db:"max_items"`
+	DefaultTTL  time.Duration `db:"default_ttl"`
+	MaxItemSize int64         `db:"max_item_size"`
+	Evict       bool          `db:"evict"`
+}
+
+// Blob is a deduplicated value that is shared by one or more items
+type Blob struct {
+	Hash      string    `db:"hash"`
+	Size      int64     `db:"size"`
+	Refcount  int64     `db:"refcount"`
+	CreatedAt time.Time `db:"created_at"`
 }
\ No newline at end of file
@@ -2,9 +2,12 @@ package calmcache
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 	"sync"
 
+	"github.com/imclaren/calmcache/blobstore"
+	"github.com/imclaren/calmcache/codec"
 	"github.com/imclaren/calmcache/dbcache"
 	"github.com/imclaren/calmcache/filecache"
 )
@@ -14,46 +17,140 @@ const (
 	FCName = "files"
 )
 
-// Cache is the calmcache struct
+// Cache is the calmcache struct.
+// The cache state is shared by copies of a Cache, so a Cache that is returned by Open can be copied.
 type Cache struct {
+	*cacheState
+}
+
+// cacheState is the state of an open cache
+type cacheState struct {
 	sync.RWMutex
-	ctx    context.Context
-	cancel context.CancelFunc
-	Path   string
-	DBPath string
-	DB     *dbcache.DB
-	FCPath string
-	FC     *filecache.FileCache
+	ctx         context.Context
+	cancel      context.CancelFunc
+	opts        Options
+	janitorDone chan struct{}
+	Path        string
+	DBPath      string
+	DB          *dbcache.DB
+	FCPath      string
+	// FC is the file cache.  FC is nil if the cache uses a BlobStore that is not a file cache.
+	FC *filecache.FileCache
+	// Store stores the cached values
+	Store blobstore.BlobStore
+	// closed is true after the cache has been closed (see ErrClosed)
+	closed bool
+	// items locks single items (e.g. items that are pinned by a Reader), and buckets locks buckets (see lockItem)
+	items   lockTable
+	buckets lockTable
+	// paths holds the items that are locked by GetPathAndLock
+	paths pathLocks
 }
 
 // Open opens and initiates the cache.
 // Note that this is not thread safe.  Use Cache.Open for thread safe openining of the Cache.
 func Open(path string) (c Cache, err error) {
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenWithOptions opens and initiates the cache with the provided options, and starts the janitor if required.
+// Note that this is not thread safe.  Use Cache.Open for thread safe openining of the Cache.
+func OpenWithOptions(path string, opts Options) (c Cache, err error) {
 	DBPath := filepath.Join(path, DBName)
 	FCPath := filepath.Join(path, FCName)
+	for bucket, name := range opts.BucketCodecs {
+		err = codec.Valid(name)
+		if err != nil {
+			return Cache{}, fmt.Errorf("cache open error: bucket %s: %v", bucket, err)
+		}
+	}
+	for keyID, key := range opts.EncryptionKeys {
+		err = codec.ValidKey(key)
+		if err != nil {
+			return Cache{}, fmt.Errorf("cache open error: encryption key %s: %v", keyID, err)
+		}
+	}
+	if _, ok := opts.EncryptionKeys[opts.EncryptionKeyID]; opts.EncryptionKeyID != "" && !ok {
+		return Cache{}, fmt.Errorf("cache open error: unknown encryption key ID: %s", opts.EncryptionKeyID)
+	}
 	path, dirMode, err := filecache.MakeCacheDir(path)
 	if err != nil {
 		return Cache{}, err
 	}
 	ctx, cancel := context.WithCancel(context.Background())
-	DB, err := dbcache.Init(DBPath, ctx, cancel)
+	DB, err := initDB(DBPath, opts, ctx, cancel)
 	if err != nil {
+		cancel()
 		return Cache{}, err
 	}
-	FC, err := filecache.Init(FCPath, dirMode)
-	if err != nil {
-		return Cache{}, err
-	}
-	return Cache{
+	c = Cache{&cacheState{
 		//mu: nil,
 		ctx:    ctx,
 		cancel: cancel,
+		opts:   opts,
 		Path:   path,
 		DBPath: DBPath,
-		DB:     &DB,
+		DB:     DB,
 		FCPath: FCPath,
-		FC:     &FC,
-	}, nil
+		Store:  opts.BlobStore,
+	}}
+	if c.Store == nil {
+		FC, err := filecache.Init(FCPath, dirMode)
+		if err != nil {
+			cancel()
+			return Cache{}, err
+		}
+		c.Store = &FC
+	}
+	if FC, ok := c.Store.(*filecache.FileCache); ok {
+		c.FC = FC
+		// New caches use the hashed layout, and existing caches keep their layout
+		layout, err := c.DB.InitMeta("layout", filecache.LayoutHashed)
+		if err != nil {
+			cancel()
+			return Cache{}, err
+		}
+		err = c.FC.SetLayout(layout)
+		if err != nil {
+			cancel()
+			return Cache{}, err
+		}
+		// Files are found in the previous layout until an interrupted MigrateLayout is resumed
+		previous, _, err := c.DB.GetMeta("previous_layout")
+		if err != nil {
+			cancel()
+			return Cache{}, err
+		}
+		err = c.FC.SetPreviousLayout(previous)
+		if err != nil {
+			cancel()
+			return Cache{}, err
+		}
+	}
+	c.startJanitor()
+	return c, nil
+}
+
+// OpenWithDB opens and initiates the cache, using a database of type dbType (i.e. "sqlite" or "postgres") with the dsn connect string.
+// Note that this is not thread safe.  Use Cache.Open for thread safe openining of the Cache.
+func OpenWithDB(path, dbType, dsn string) (c Cache, err error) {
+	return OpenWithOptions(path, Options{DBType: dbType, DSN: dsn})
+}
+
+// initDB initiates the cache database.  The sqlite database in the cache directory is used unless a DSN is provided.
+func initDB(DBPath string, opts Options, ctx context.Context, cancel context.CancelFunc) (*dbcache.DB, error) {
+	if opts.DSN == "" && (opts.DBType == "" || opts.DBType == "sqlite") {
+		return dbcache.Init(DBPath, ctx, cancel)
+	}
+	return dbcache.InitWithDSN(opts.DBType, opts.DSN, ctx, cancel)
+}
+
+// openDB opens the cache database.  The sqlite database in the cache directory is used unless a DSN is provided.
+func openDB(DBPath string, opts Options, ctx context.Context, cancel context.CancelFunc) (*dbcache.DB, error) {
+	if opts.DSN == "" && (opts.DBType == "" || opts.DBType == "sqlite") {
+		return dbcache.Open(DBPath, ctx, cancel)
+	}
+	return dbcache.OpenWithDSN(opts.DBType, opts.DSN, ctx, cancel)
 }
 
 // Open opens the cache in a thread safe manner
@@ -61,18 +158,36 @@ func (c *Cache) Open() error {
 	c.Lock()
 	defer c.Unlock()
 
-	DB, err := dbcache.Open(c.DBPath, c.ctx, c.cancel)
+	if c.ctx.Err() != nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	DB, err := openDB(c.DBPath, c.opts, c.ctx, c.cancel)
 	if err != nil {
 		return err
 	}
-	c.DB = &DB
+	c.DB = DB
+	c.closed = false
+	if c.janitorDone == nil {
+		c.startJanitor()
+	}
 	return nil
 }
 
-// Close closes the cache
+// Close closes the cache, and stops the janitor if it is running
 func (c *Cache) Close() error {
+	c.stopJanitor()
+
 	c.Lock()
 	defer c.Unlock()
 
+	c.closed = true
 	return c.DB.Close()
 }
+
+// checkOpen returns ErrClosed if the cache has been closed.  Note that the cache must be locked by the caller.
+func (c *Cache) checkOpen() error {
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
@@ -3,8 +3,25 @@ package calmcache
 import (
 	"testing"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/imclaren/calmcache/blobstore"
+	"github.com/imclaren/calmcache/cacheitem"
+	"github.com/imclaren/calmcache/codec"
+	"github.com/imclaren/calmcache/dbcache"
+	"github.com/imclaren/calmcache/filecache"
+	"github.com/imclaren/sqldb/sqlite"
 	assert "github.com/stretchr/testify/require"
 )
 
@@ -253,16 +270,16 @@ func (c *Cache) TestReaderAndGetPath(t *testing.T) {
 
 			OK, fullPath, _, err := c.GetPathAndLock(bucket, key) 
 			if err != nil {
-				c.GetPathUnlock()
+				c.GetPathUnlock(bucket, key)
 				t.Fatal(err)
 			}
 			assert.True(t, OK)
 			b, err := ioutil.ReadFile(fullPath)
 			if err != nil {
-				c.GetPathUnlock()
+				c.GetPathUnlock(bucket, key)
 				t.Fatal(err)
 			}
-			c.GetPathUnlock()
+			c.GetPathUnlock(bucket, key)
 			assert.Equal(t, b, testCase.bytes)
 		}
 		allKeys, err := c.AllKeys(bucket)
@@ -274,3 +291,2585 @@ func (c *Cache) TestReaderAndGetPath(t *testing.T) {
 }
 
 
+
+func TestTTL(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	OK, err := c.PutWithTTL(bucket, key, []byte("123"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	OK, err = c.PutWithReaderTTL(bucket, "testkey2", bytes.NewReader([]byte("456")), 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	outBytes, err := c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+
+	time.Sleep(200 * time.Millisecond)
+
+	exists, err := c.Exists(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, exists)
+	outBytes, err = c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, outBytes)
+	allKeys, err := c.AllKeys(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"testkey2"}, allKeys)
+
+	// Expired items can be replaced
+	OK, err = c.PutWithTTL(bucket, key, []byte("789"), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	time.Sleep(100 * time.Millisecond)
+	var buf bytes.Buffer
+	OK, err = c.GetToWriter(bucket, key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	assert.Equal(t, 0, buf.Len())
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		JanitorInterval:   20 * time.Millisecond,
+		BucketTargetSizes: map[string]int64{"sizedbucket": 6},
+		JanitorErrorHandler: func(err error) {
+			t.Error(err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	_, err = c.PutWithTTL(bucket, key, []byte("123"), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"testkey1", "testkey2", "testkey3"} {
+		_, err = c.Put("sizedbucket", key, []byte("123"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	count, err := c.DB.AllInBucketCount(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, count)
+	size, err := c.DB.BucketSize("sizedbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(6), size)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, c.janitorDone)
+
+	// The janitor is restarted when the cache is reopened, and closing the cache again does not block
+	err = c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, c.janitorDone)
+	var wg sync.WaitGroup
+	for n := 0; n < 2; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, c.janitorDone)
+}
+
+func TestReplaceAndCompareAndSwap(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	// CompareAndSwap with version 0 only puts absent items
+	OK, err := c.CompareAndSwap(bucket, key, 0, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	OK, err = c.CompareAndSwap(bucket, key, 0, []byte("456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	OK, err = c.PutIfAbsent(bucket, key, []byte("456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+
+	OK, version, err := c.Version(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, int64(1), version)
+
+	err = c.Replace(bucket, key, []byte("4567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "4567", string(outBytes))
+	size, err := c.DB.BucketSize(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(4), size)
+
+	// A stale version does not overwrite the value
+	OK, err = c.CompareAndSwapWithReader(bucket, key, version, bytes.NewReader([]byte("789")), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	_, version, err = c.Version(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(2), version)
+	OK, err = c.CompareAndSwapWithReader(bucket, key, version, bytes.NewReader([]byte("789")), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	outBytes, err = c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "789", string(outBytes))
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type errReader struct{}
+
+func (r errReader) Read(p []byte) (n int, err error) {
+	return 0, fmt.Errorf("read error")
+}
+
+func TestAtomicWrite(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	_, err = c.Put(bucket, key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write leaves the existing value in place
+	r := io.MultiReader(bytes.NewReader([]byte("45")), errReader{})
+	err = c.ReplaceWithReader(bucket, key, r, 6)
+	assert.Error(t, err)
+	outBytes, err := c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+
+	// A failed database update leaves the existing value in place
+	_, err = c.DB.Exec("CREATE TRIGGER fail_update BEFORE UPDATE ON cache BEGIN SELECT RAISE(ABORT, 'update failed'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Replace(bucket, key, []byte("456"))
+	assert.Error(t, err)
+	_, err = c.DB.Exec("DROP TRIGGER fail_update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err = c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+	report, err := c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+
+	// A failed write to a new key does not leave a file behind
+	_, err = c.PutWithReader(bucket, "testkey2", errReader{}, 3)
+	assert.Error(t, err)
+	exists, err := c.Exists(bucket, "testkey2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, exists)
+
+	fullPath, err := c.FC.FilePath(bucket, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk(c.FCPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		assert.False(t, filecache.IsTempFile(info.Name()), path)
+		if !info.IsDir() {
+			assert.Equal(t, fullPath, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetPathAndLock(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	_, err = c.Put(bucket, key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	OK, fullPath, _, err := c.GetPathAndLock(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+
+	// Puts and deletes of the item wait until GetPathUnlock is called, so the file stays valid
+	replaced := make(chan error)
+	go func() {
+		replaced <- c.Replace(bucket, key, []byte("456"))
+	}()
+	deleted := make(chan error)
+	go func() {
+		_, err := c.Delete(bucket, key)
+		deleted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(b))
+	select {
+	case <-replaced:
+		t.Fatal("replaced while the path was locked")
+	case <-deleted:
+		t.Fatal("deleted while the path was locked")
+	default:
+	}
+
+	// Unlocking an item that is not locked does nothing
+	c.GetPathUnlock(bucket, "testkey2")
+	c.GetPathUnlock(bucket, key)
+	for _, ch := range []chan error{replaced, deleted} {
+		err = <-ch
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			t.Fatal(err)
+		}
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	for _, key := range []string{"testkey", "testkey2", "testkey3"} {
+		_, err = c.Put(bucket, key, []byte("123"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Items)
+	assert.Equal(t, 3, report.Files)
+
+	// Remove a file, change the size of a file, and add an orphan file
+	fullPath, err := c.FC.FilePath(bucket, "testkey2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullPath, err = c.FC.FilePath(bucket, "testkey3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fullPath, []byte("12345"), filecache.FileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphanPath, err := c.FC.FilePath(bucket, "orphankey", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(orphanPath, []byte("1234"), filecache.FileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Repairs are not accesses, so the last accessed times are not changed
+	before, err := c.DB.GetItem(bucket, "testkey3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Orphan files stored by key hash cannot be reindexed (see TestLegacyLayout)
+	report, err = c.Check(context.Background(), CheckOptions{Repair: true, Reindex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, report.OK())
+	assert.Equal(t, 1, len(report.DanglingRows))
+	assert.Equal(t, "testkey2", report.DanglingRows[0].Key)
+	assert.Equal(t, 1, len(report.SizeMismatches))
+	assert.Equal(t, int64(5), report.SizeMismatches[0].FileSize)
+	assert.Equal(t, 1, len(report.OrphanFiles))
+	assert.Equal(t, orphanPath, report.OrphanFiles[0].Path)
+	assert.Equal(t, 3, report.Repaired)
+
+	report, err = c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	allKeys, err := c.AllKeys(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"testkey", "testkey3"}, allKeys)
+	size, err := c.DB.BucketSize(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(8), size)
+	after, err := c.DB.GetItem(bucket, "testkey3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(5), after.Size)
+	assert.Equal(t, before.UpdatedAt, after.UpdatedAt)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBucketScopedKeys(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	for _, bucket := range []string{"bucket1", "bucket2"} {
+		OK, err := c.Put(bucket, key, []byte(bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+	}
+	for _, bucket := range []string{"bucket1", "bucket2"} {
+		outBytes, err := c.Get(bucket, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, bucket, string(outBytes))
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacySchema(t *testing.T) {
+	// Create a cache database with the schema used before migrations were added
+	_, _, err := filecache.MakeCacheDir(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := dbcache.Open(filepath.Join(cachePath, DBName), ctx, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sqlString := range []string{
+		`CREATE TABLE cache (
+			id INTEGER PRIMARY KEY,
+			bucket TEXT,
+			key TEXT,
+			size INT,
+			access_count INT,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+			updated_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))
+		)`,
+		"CREATE UNIQUE INDEX cache_key_idx ON cache (key)",
+		"INSERT INTO cache (bucket, key, size, access_count, expires_at) VALUES ('bucket1', 'testkey', 3, 0, '0001-01-01 00:00:00+00:00')",
+	} {
+		_, err = db.Exec(sqlString)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	version, err := c.DB.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, version >= 3)
+	OK, version64, err := c.Version("bucket1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, int64(1), version64)
+	OK, err = c.Put("bucket2", key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenWithDB(t *testing.T) {
+	tempDirName, err := ioutil.TempDir("", "calmcachedsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDirName)
+
+	c, err := OpenWithDB(cachePath, "sqlite", sqlite.ConnectString(filepath.Join(tempDirName, "index.db"), "UTC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TestSelect(t)
+	c.TestPut(t)
+	c.TestPutAndDelete(t)
+
+	_, err = os.Stat(filepath.Join(cachePath, DBName))
+	assert.True(t, os.IsNotExist(err))
+
+	// Deleting the cache deletes the rows of all of the cache tables
+	_, err = c.PutWithOptions(bucket, key, []byte("123"), PutOptions{Tags: []string{"testtag"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetBucketConfig(bucket, BucketConfig{MaxItems: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.DeleteCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"cache", "cache_tags", "blobs", "buckets", "cache_stats", "meta"} {
+		var count int
+		err = c.DB.Get(&count, "SELECT COUNT(*) FROM "+table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, count, table)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPostgres runs against the postgres database in the CALMCACHE_POSTGRES_DSN environment variable
+// e.g. CALMCACHE_POSTGRES_DSN="postgres://postgres@localhost/calmcache_test?sslmode=disable"
+// The postgres statements are also tested without a database in the dbcache package (see TestPostgresMigrate).
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("CALMCACHE_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CALMCACHE_POSTGRES_DSN not set")
+	}
+	c, err := OpenWithDB(cachePath, "postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+	err = c.DB.DeleteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.TestSelect(t)
+	c.TestPut(t)
+	c.TestPutAndDelete(t)
+	c.TestReaderAndGetPath(t)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{BlobStore: blobstore.NewMemory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, c.FC)
+	_, err = os.Stat(c.FCPath)
+	assert.True(t, os.IsNotExist(err))
+
+	c.TestSelect(t)
+	c.TestPut(t)
+	c.TestPutAndDelete(t)
+
+	_, err = c.Put(bucket, key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	OK, err := c.GetToWriter(bucket, key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, "123", buf.String())
+	_, _, _, err = c.GetPathAndLock(bucket, key)
+	assert.Error(t, err)
+
+	err = c.Store.Remove(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Check(context.Background(), CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(report.DanglingRows))
+
+	err = c.DeleteCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	for _, key := range []string{"testkey", "testkey2", "testkey3"} {
+		_, err = c.Put(bucket, key, []byte("123"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	i, err := c.DB.GetItem(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3", i.Checksum)
+	outBytes, err := c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+
+	// Corrupt the files without changing their size
+	for _, key := range []string{"testkey", "testkey2", "testkey3"} {
+		fullPath, err := c.FC.FilePath(bucket, key, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fullPath, []byte("124"), filecache.FileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = c.Get(bucket, key)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	var buf bytes.Buffer
+	_, err = c.GetToWriter(bucket, "testkey2", &buf)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+
+	// Errors deleting corrupt items are returned with the corrupt error
+	_, err = c.DB.Exec("CREATE TRIGGER fail_delete BEFORE DELETE ON cache BEGIN SELECT RAISE(ABORT, 'delete failed'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(bucket, "testkey3")
+	var corruptErr *CorruptError
+	assert.True(t, errors.As(err, &corruptErr))
+	assert.Equal(t, "testkey3", corruptErr.Key)
+	assert.Contains(t, err.Error(), "delete failed")
+	_, err = c.DB.Exec("DROP TRIGGER fail_delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Check(context.Background(), CheckOptions{VerifyChecksums: true, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(report.Corrupt))
+	assert.Equal(t, "testkey3", report.Corrupt[0].Key)
+
+	allKeys, err := c.AllKeys(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{}, allKeys)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	for _, key := range []string{"testkey", "testkey2"} {
+		_, err = c.Put(bucket, key, []byte("123"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = c.Put("testbucket2", key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Put(DedupBucket, key, []byte("123"))
+	assert.NotNil(t, err)
+	i, err := c.DB.GetItem(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i.Checksum, i.Blob)
+	b, err := c.DB.GetBlob(i.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(3), b.Refcount)
+	assert.Equal(t, int64(3), b.Size)
+	fullPath, err := c.FC.FilePath(DedupBucket, i.Blob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := c.Get(bucket, "testkey2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+	OK, path, _, err := c.GetPathAndLock(bucket, key)
+	c.GetPathUnlock(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, fullPath, path)
+
+	// Replacing, deleting and deleting buckets release references
+	err = c.Replace(bucket, key, []byte("456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err = c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "456", string(outBytes))
+	_, err = c.Delete(bucket, "testkey2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = c.DB.GetBlob(i.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1), b.Refcount)
+	report, err := c.Check(context.Background(), CheckOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	err = c.DeleteBucket("testbucket2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = c.DB.GetBlob(i.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, b)
+	_, err = os.Stat(fullPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Check repairs reference counts
+	_, err = c.DB.Exec("UPDATE blobs SET refcount = 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = c.Check(context.Background(), CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(report.RefcountMismatches))
+	_, err = c.Delete(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := c.DB.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(0), size)
+	report, err = c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, report.Files)
+
+	// A failed replacement of a deduplicated value without deduplication does not leave a file behind
+	_, err = c.Put(bucket, key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenWithOptions(cachePath, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DB.Exec("CREATE TRIGGER fail_update BEFORE UPDATE ON cache BEGIN SELECT RAISE(ABORT, 'update failed'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Replace(bucket, key, []byte("456"))
+	assert.Error(t, err)
+	_, err = c.DB.Exec("DROP TRIGGER fail_update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err = c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+	keyPath, err := c.FC.FilePath(bucket, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(keyPath)
+	assert.True(t, os.IsNotExist(err))
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		VerifyChecksums: true,
+		BucketCodecs:    map[string]string{bucket: codec.Gzip, "testbucket2": codec.Zstd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := bytes.Repeat([]byte(`{"level":"info","msg":"calmcache"}`), 1000)
+	for _, b := range []string{bucket, "testbucket2", "testbucket3"} {
+		_, err = c.Put(b, key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, err := c.DB.GetItem(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(len(value)), i.Size)
+		if b == "testbucket3" {
+			assert.Equal(t, i.Size, i.StoredSize)
+		} else {
+			assert.Less(t, i.StoredSize, i.Size/10)
+		}
+		outBytes, err := c.Get(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, outBytes)
+		var buf bytes.Buffer
+		OK, err := c.GetToWriter(b, key, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		assert.Equal(t, value, buf.Bytes())
+	}
+	_, _, _, err = c.GetPathAndLock(bucket, key)
+	assert.NotNil(t, err)
+	report, err := c.Check(context.Background(), CheckOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+
+	size, err := c.DB.BucketSize(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(value)), size)
+	err = c.PruneToStoredSize(bucket, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := c.Exists(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, exists)
+	err = c.PruneToSize(bucket, size-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err = c.Exists(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, exists)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenWithOptions(cachePath, Options{BucketCodecs: map[string]string{bucket: "lz4"}})
+	assert.NotNil(t, err)
+}
+
+func TestEncryption(t *testing.T) {
+	keys := map[string][]byte{
+		"key1": bytes.Repeat([]byte{1}, 32),
+		"key2": bytes.Repeat([]byte{2}, 32),
+	}
+	c, err := OpenWithOptions(cachePath, Options{
+		VerifyChecksums: true,
+		BucketCodecs:    map[string]string{"testbucket2": codec.Zstd},
+		EncryptionKeys:  keys,
+		EncryptionKeyID: "key1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := bytes.Repeat([]byte("calmcache "), 20000)
+	for _, b := range []string{bucket, "testbucket2"} {
+		_, err = c.Put(b, key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, err := c.DB.GetItem(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "key1", i.KeyID)
+		fullPath, err := c.FC.FilePath(b, key, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, bytes.Contains(stored, []byte("calmcache")))
+		outBytes, err := c.Get(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, outBytes)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to key2
+	c, err = OpenWithOptions(cachePath, Options{
+		VerifyChecksums: true,
+		BucketCodecs:    map[string]string{"testbucket2": codec.Zstd},
+		EncryptionKeys:  keys,
+		EncryptionKeyID: "key2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, version, err := c.Version(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ok)
+	// Re-encryption is not an access, so the last accessed times are not changed
+	updatedAt := map[string]time.Time{}
+	for _, b := range []string{bucket, "testbucket2"} {
+		i, err := c.DB.GetItem(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updatedAt[b] = i.UpdatedAt
+	}
+	time.Sleep(10 * time.Millisecond)
+	count, err := c.RotateKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, count)
+	for _, b := range []string{bucket, "testbucket2"} {
+		i, err := c.DB.GetItem(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "key2", i.KeyID)
+		assert.Equal(t, version, i.Version)
+		assert.Equal(t, updatedAt[b], i.UpdatedAt)
+		var buf bytes.Buffer
+		_, err = c.GetToWriter(b, key, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, buf.Bytes())
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// key1 is no longer needed
+	c, err = OpenWithOptions(cachePath, Options{
+		EncryptionKeys:  map[string][]byte{"key2": keys["key2"]},
+		EncryptionKeyID: "key2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, value, outBytes)
+	report, err := c.Check(context.Background(), CheckOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenWithOptions(cachePath, Options{EncryptionKeys: keys, EncryptionKeyID: "key3"})
+	assert.NotNil(t, err)
+	_, err = OpenWithOptions(cachePath, Options{EncryptionKeys: map[string][]byte{"key1": []byte("short")}})
+	assert.NotNil(t, err)
+}
+
+func TestRotateKeysFailure(t *testing.T) {
+	keys := map[string][]byte{
+		"key1": bytes.Repeat([]byte{1}, 32),
+		"key2": bytes.Repeat([]byte{2}, 32),
+	}
+	c, err := OpenWithOptions(cachePath, Options{
+		Dedup:           true,
+		EncryptionKeys:  keys,
+		EncryptionKeyID: "key1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+	_, err = c.Put(bucket, key, []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed rotation of a deduplicated value without deduplication does not leave a file behind
+	c, err = OpenWithOptions(cachePath, Options{
+		EncryptionKeys:  keys,
+		EncryptionKeyID: "key2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DB.Exec("CREATE TRIGGER fail_update BEFORE UPDATE ON cache BEGIN SELECT RAISE(ABORT, 'update failed'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.RotateKeys(context.Background())
+	assert.Error(t, err)
+	_, err = c.DB.Exec("DROP TRIGGER fail_update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := c.Get(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "123", string(outBytes))
+	keyPath, err := c.FC.FilePath(bucket, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(keyPath)
+	assert.True(t, os.IsNotExist(err))
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafePaths(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	assert.Equal(t, filecache.LayoutHashed, c.FC.Layout())
+	keys := []string{"../../escape", "a/b/c", "..", "Key", "key", string(bytes.Repeat([]byte("k"), 1000))}
+	for _, key := range keys {
+		_, err = c.Put(bucket, key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		outBytes, err := c.Get(bucket, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, key, string(outBytes))
+		fullPath, err := c.FC.FilePath(bucket, key, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(filepath.Join(c.FCPath, bucket), fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, filepath.Join(cacheitem.KeyHash(key)[0:2], cacheitem.KeyHash(key)[2:4], cacheitem.KeyHash(key)), rel)
+	}
+	report, err := c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	assert.Equal(t, len(keys), report.Files)
+
+	for _, b := range []string{"", ".", "..", "../escape", "a/b", "a\\b", DedupBucket} {
+		_, err = c.Put(b, key, []byte("123"))
+		assert.NotNil(t, err, b)
+		err = c.DeleteBucket(b)
+		assert.NotNil(t, err, b)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyLayout(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+	err = c.DB.SetMeta("layout", filecache.LayoutLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Caches keep their layout
+	c, err = Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filecache.LayoutLegacy, c.FC.Layout())
+	_, err = c.Put(bucket, "test.jpg", []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullPath, err := c.FC.FilePath(bucket, "test.jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(c.FCPath, bucket, "jpg", "test", "test.jpg"), fullPath)
+	for _, key := range []string{"../../escape", "a/b", "..", "abcd...txt", string(bytes.Repeat([]byte("k"), 1000))} {
+		_, err = c.Put(bucket, key, []byte("123"))
+		assert.NotNil(t, err, key)
+	}
+
+	// Orphan files stored by key can be reindexed
+	orphanPath, err := c.FC.FilePath(bucket, "orphankey", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(orphanPath, []byte("1234"), filecache.FileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Check(context.Background(), CheckOptions{Repair: true, Reindex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(report.OrphanFiles))
+	assert.Equal(t, "orphankey", report.OrphanFiles[0].Key)
+	allKeys, err := c.AllKeys(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"orphankey", "test.jpg"}, allKeys)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+	err = c.DB.SetMeta("layout", filecache.LayoutLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenWithOptions(cachePath, Options{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filecache.LayoutLegacy, c.Layout())
+	keys := []string{"test.jpg", "testkey", "testkey2", "testkey3"}
+	for _, key := range keys {
+		_, err = c.Put(bucket, key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Interrupt a migration to the flat layout before any files are moved
+	err = c.startLayoutMigration(filecache.LayoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.MigrateLayout(context.Background(), filecache.LayoutHashed)
+	assert.NotNil(t, err)
+	_, err = c.Check(context.Background(), CheckOptions{})
+	assert.NotNil(t, err)
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files that have not been moved are found in the previous layout
+	c, err = OpenWithOptions(cachePath, Options{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filecache.LayoutFlat, c.Layout())
+	assert.Equal(t, filecache.LayoutLegacy, c.FC.PreviousLayout())
+	outBytes, err := c.Get(bucket, "testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "testkey", string(outBytes))
+	err = c.Replace(bucket, "testkey2", []byte("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Delete(bucket, "testkey3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := c.MigrateLayout(context.Background(), filecache.LayoutFlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, moved)
+	assert.Equal(t, "", c.FC.PreviousLayout())
+	fullPath, err := c.FC.FilePath(bucket, "test.jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(c.FCPath, bucket, "test.jpg"), fullPath)
+	report, err := c.Check(context.Background(), CheckOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	assert.Equal(t, 3, report.Items)
+
+	// Setting the key hashes of items is not an access, so the last accessed times are not changed
+	_, err = c.DB.Exec("UPDATE cache SET key_hash = ''")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.DB.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.MigrateLayout(context.Background(), filecache.LayoutHashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range items {
+		migrated, err := c.DB.GetItem(i.Bucket, i.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cacheitem.KeyHash(i.Key), migrated.KeyHash)
+		assert.Equal(t, i.UpdatedAt, migrated.UpdatedAt)
+	}
+
+	// Keys that cannot be used with a layout are rejected before any files are moved
+	_, err = c.Put(bucket, "a/b", []byte("123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.MigrateLayout(context.Background(), filecache.LayoutLegacy)
+	assert.NotNil(t, err)
+	assert.Equal(t, filecache.LayoutHashed, c.Layout())
+	report, err = c.Check(context.Background(), CheckOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+	for _, key := range []string{"test.jpg", "testkey", "testkey2", "a/b"} {
+		exists, err := c.Exists(bucket, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, exists, key)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		BucketCodecs: map[string]string{"testbucket2": codec.Gzip},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, b := range []string{bucket, "testbucket2"} {
+		_, err = c.Put(b, key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		OK, r, err := c.GetReader(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		info := r.Stat()
+		assert.Equal(t, b, info.Bucket)
+		assert.Equal(t, int64(len(value)), info.Size)
+		assert.Equal(t, int64(1), info.Version)
+
+		// Read, ReadAt and Seek
+		p := make([]byte, 10)
+		_, err = io.ReadFull(r, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value[:10], p)
+		_, err = r.ReadAt(p, 5005)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value[5005:5015], p)
+		n, err := r.ReadAt(p, int64(len(value))-5)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, io.EOF, err)
+		_, err = r.Seek(-20, io.SeekEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value[len(value)-20:], rest)
+
+		// Other items can be put while the item is pinned
+		_, err = c.Put(b, "otherkey", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Pinned items are not pruned
+		err = c.PruneToSize(b, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err := c.Exists(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, exists)
+		exists, err = c.Exists(b, "otherkey")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, exists)
+
+		// Replacing the item waits until the Reader is closed
+		replaced := make(chan error)
+		go func() {
+			replaced <- c.Replace(b, key, []byte("newvalue"))
+		}()
+		select {
+		case err = <-replaced:
+			t.Fatalf("replace did not wait for the reader to be closed: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		err = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Closing the Reader again does nothing
+		err = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = <-replaced
+		if err != nil {
+			t.Fatal(err)
+		}
+		outBytes, err := c.Get(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []byte("newvalue"), outBytes)
+	}
+
+	OK, r, err := c.GetReader(bucket, "missingkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	assert.Nil(t, r)
+}
+
+func TestConcurrency(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			for n := 0; n < 50; n++ {
+				k := fmt.Sprintf("key%d-%d", w, n%5)
+				value := []byte(fmt.Sprintf("value%d", n%3))
+				err := c.Replace(bucket, k, value)
+				if err != nil {
+					errs <- err
+					return
+				}
+				outBytes, err := c.Get(bucket, k)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(value, outBytes) {
+					errs <- fmt.Errorf("unexpected value for %s: %s", k, outBytes)
+					return
+				}
+				if n%4 == 0 {
+					_, err = c.Delete(bucket, k)
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		err = <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+}
+
+// globalLock is an extra lock that the global and mutex benchmark variants take around the current code, to approximate
+// a single cache lock (puts hold the write lock, and gets hold the read lock).  The variants are simulations, not the code
+// that was used before items were locked separately, so compare against an earlier commit (e.g. with benchstat) to measure that.
+var globalLock sync.RWMutex
+
+var benchmarkValue = bytes.Repeat([]byte("0123456789"), 1000)
+
+func benchmarkPut(c *Cache, n int64) error {
+	_, err := c.Put(bucket, fmt.Sprintf("newkey%d", n), benchmarkValue)
+	return err
+}
+
+func benchmarkGet(c *Cache, n int64) error {
+	_, err := c.GetToWriter(bucket, fmt.Sprintf("key%d", n%100), ioutil.Discard)
+	return err
+}
+
+// benchmarkParallel runs puts (if put returns true for n) and gets in parallel.  If global is true, each operation holds globalLock.
+func benchmarkParallel(b *testing.B, global bool, put func(n int64) bool) {
+	c, err := Open(cachePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	for n := int64(0); n < 100; n++ {
+		_, err = c.Put(bucket, fmt.Sprintf("key%d", n), benchmarkValue)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	var counter int64
+	b.SetBytes(int64(len(benchmarkValue)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&counter, 1)
+			var err error
+			switch {
+			case put(n) && global:
+				globalLock.Lock()
+				err = benchmarkPut(&c, n)
+				globalLock.Unlock()
+			case put(n):
+				err = benchmarkPut(&c, n)
+			case global:
+				globalLock.RLock()
+				err = benchmarkGet(&c, n)
+				globalLock.RUnlock()
+			default:
+				err = benchmarkGet(&c, n)
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkPutParallel(b *testing.B) {
+	put := func(n int64) bool { return true }
+	b.Run("striped", func(b *testing.B) { benchmarkParallel(b, false, put) })
+	b.Run("global", func(b *testing.B) { benchmarkParallel(b, true, put) })
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	put := func(n int64) bool { return false }
+	b.Run("striped", func(b *testing.B) { benchmarkParallel(b, false, put) })
+	b.Run("global", func(b *testing.B) { benchmarkParallel(b, true, put) })
+}
+
+func BenchmarkPutAndGetParallel(b *testing.B) {
+	put := func(n int64) bool { return n%2 == 0 }
+	b.Run("striped", func(b *testing.B) { benchmarkParallel(b, false, put) })
+	b.Run("global", func(b *testing.B) { benchmarkParallel(b, true, put) })
+}
+
+// BenchmarkDBParallel reads items and updates their access counts in parallel in the database.
+// The mutex variant holds globalLock for each statement, to simulate a process wide database lock (see globalLock).
+func BenchmarkDBParallel(b *testing.B) {
+	b.Run("concurrent", func(b *testing.B) { benchmarkDBParallel(b, false) })
+	b.Run("mutex", func(b *testing.B) { benchmarkDBParallel(b, true) })
+}
+
+func benchmarkDBParallel(b *testing.B, mutex bool) {
+	c, err := Open(cachePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	for n := int64(0); n < 100; n++ {
+		_, err = c.Put(bucket, fmt.Sprintf("key%d", n), benchmarkValue)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	var counter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&counter, 1)
+			key := fmt.Sprintf("key%d", n%100)
+			var err error
+			switch {
+			case n%4 == 0 && mutex:
+				globalLock.Lock()
+				err = c.DB.UpdateAccessCount(bucket, key)
+				globalLock.Unlock()
+			case n%4 == 0:
+				err = c.DB.UpdateAccessCount(bucket, key)
+			case mutex:
+				globalLock.RLock()
+				_, err = c.DB.GetItem(bucket, key)
+				globalLock.RUnlock()
+			default:
+				_, err = c.DB.GetItem(bucket, key)
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// cancelReader cancels a context after the first read
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r cancelReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.r.Read(p)
+}
+
+// cancelWriter cancels a context after the first write
+type cancelWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) Write(p []byte) (int, error) {
+	defer w.cancel()
+	return w.w.Write(p)
+}
+
+func TestContext(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		BucketCodecs: map[string]string{"testbucket2": codec.Gzip},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := bytes.Repeat([]byte("0123456789"), 100000)
+	for _, b := range []string{bucket, "testbucket2"} {
+		// Cancelled puts do not store partial values
+		ctx, cancel := context.WithCancel(context.Background())
+		OK, err := c.PutWithReaderContext(ctx, b, key, cancelReader{bytes.NewReader(value), cancel}, int64(len(value)))
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.False(t, OK)
+		exists, err := c.Exists(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, exists)
+		report, err := c.Check(context.Background(), CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, report.OK())
+		files, err := ioutil.ReadDir(c.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range files {
+			assert.False(t, strings.HasPrefix(fi.Name(), ".spool"))
+		}
+
+		// Cancelled gets stop copying
+		OK, err = c.PutContext(context.Background(), b, key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		ctx, cancel = context.WithCancel(context.Background())
+		var buf bytes.Buffer
+		OK, err = c.GetToWriterContext(ctx, b, key, cancelWriter{&buf, cancel})
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.False(t, OK)
+		assert.Less(t, buf.Len(), len(value))
+		_, err = c.GetContext(ctx, b, key)
+		assert.True(t, errors.Is(err, context.Canceled))
+		outBytes, err := c.GetContext(context.Background(), b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, outBytes)
+
+		// Cancelled prunes do not delete items
+		err = c.PruneToSizeContext(ctx, b, 0)
+		assert.True(t, errors.Is(err, context.Canceled))
+		err = c.PruneOlderThanContext(ctx, b, 0)
+		assert.True(t, errors.Is(err, context.Canceled))
+		exists, err = c.Exists(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, exists)
+		err = c.PruneToSizeContext(context.Background(), b, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err = c.Exists(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, exists)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := []byte("testvalue")
+	err = c.Insert(bucket, key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Insert(bucket, key, value)
+	assert.True(t, errors.Is(err, ErrExists))
+	var itemErr *ItemError
+	assert.True(t, errors.As(err, &itemErr))
+	assert.Equal(t, "insert", itemErr.Op)
+	assert.Equal(t, bucket, itemErr.Bucket)
+	assert.Equal(t, key, itemErr.Key)
+	err = c.InsertWithReader(bucket, "", bytes.NewReader(value), int64(len(value)))
+	assert.True(t, errors.Is(err, ErrEmptyKey))
+	err = c.InsertWithFile(bucket, "testkey2", "testdata/test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outBytes, err := c.Lookup(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, value, outBytes)
+	_, err = c.Lookup(bucket, "missingkey")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	_, err = c.Lookup(bucket, "")
+	assert.True(t, errors.Is(err, ErrEmptyKey))
+	var buf bytes.Buffer
+	err = c.LookupToWriter(bucket, key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, value, buf.Bytes())
+	err = c.LookupToWriter(bucket, "missingkey", &buf)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// Corrupt values
+	fullPath, err := c.FC.FilePath(bucket, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fullPath, []byte("corruptvalue"), filecache.FileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Lookup(bucket, key)
+	assert.True(t, errors.Is(err, ErrCorrupt))
+	assert.True(t, errors.As(err, &itemErr))
+
+	err = c.Remove(bucket, "testkey2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Remove(bucket, "testkey2")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// Expired items are not found
+	_, err = c.PutWithTTL(bucket, "testkey3", value, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	err = c.Remove(bucket, "testkey3")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	// Closed caches.  Copies of a Cache share the cache state, so closing a copy closes the cache.
+	copied := c
+	err = copied.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Insert(bucket, key, value)
+	assert.True(t, errors.Is(err, ErrClosed))
+	_, err = c.Lookup(bucket, key)
+	assert.True(t, errors.Is(err, ErrClosed))
+	_, err = c.Put(bucket, key, value)
+	assert.True(t, errors.Is(err, ErrClosed))
+	_, err = c.Get(bucket, key)
+	assert.True(t, errors.Is(err, ErrClosed))
+	err = c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Insert(bucket, key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		BucketCodecs: map[string]string{"testbucket2": codec.Zstd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, b := range []string{bucket, "testbucket2"} {
+		_, err = c.Put(b, key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		OK, err := c.GetRange(b, key, 12345, 100, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		assert.Equal(t, value[12345:12445], buf.Bytes())
+		buf.Reset()
+		OK, err = c.GetRange(b, key, int64(len(value))-10, -1, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		assert.Equal(t, value[len(value)-10:], buf.Bytes())
+		buf.Reset()
+		_, err = c.GetRange(b, key, int64(len(value))+1, 10, &buf)
+		assert.True(t, errors.Is(err, ErrInvalidRange))
+		OK, err = c.GetRange(b, "missingkey", 0, 10, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, OK)
+
+		p := make([]byte, 10)
+		n, err := c.ReadAt(b, key, p, 50005)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 10, n)
+		assert.Equal(t, value[50005:50015], p)
+		n, err = c.ReadAt(b, key, p, int64(len(value))-5)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, 5, n)
+		_, err = c.ReadAt(b, "missingkey", p, 0)
+		assert.True(t, errors.Is(err, ErrNotFound))
+		rest, err := ioutil.ReadAll(io.NewSectionReader(c.ReaderAt(b, key), int64(len(value))-100, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value[len(value)-100:], rest)
+
+		// Range reads update the access stats
+		i, err := c.DB.GetItem(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(6), i.AccessCount)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		BucketCodecs: map[string]string{"testbucket2": codec.Gzip},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, b := range []string{bucket, "testbucket2"} {
+		// Unknown sizes are measured
+		OK, err := c.PutWithReader(b, key, bytes.NewReader(value), SizeUnknown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		i, err := c.DB.GetItem(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(len(value)), i.Size)
+		bucketSize, err := c.DB.BucketSize(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(len(value)), bucketSize)
+		outBytes, err := c.Get(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, outBytes)
+
+		// Declared sizes must match exactly, and the existing value is kept if they do not
+		for _, size := range []int64{int64(len(value)) - 1, int64(len(value)) + 1} {
+			err = c.ReplaceWithReader(b, key, bytes.NewReader(value), size)
+			assert.True(t, errors.Is(err, ErrSizeMismatch))
+			outBytes, err = c.Get(b, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, value, outBytes)
+		}
+		_, err = c.PutWithReader(b, "testkey2", bytes.NewReader(value), -2)
+		assert.NotNil(t, err)
+	}
+	report, err := c.Check(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, report.OK())
+}
+
+func TestMetadata(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := []byte("test value")
+
+	// Items without metadata use the checksum as the ETag
+	OK, err := c.Put(bucket, key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	OK, info, err := c.Stat(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, int64(len(value)), info.Size)
+	assert.Equal(t, "", info.ContentType)
+	assert.Equal(t, info.Checksum, info.ETag)
+	assert.Nil(t, info.Metadata)
+
+	// Existing values are only overwritten if Replace is true
+	opts := PutOptions{
+		ContentType:     "text/plain",
+		ContentEncoding: "identity",
+		ETag:            `"v2"`,
+		Metadata:        map[string]string{"owner": "test", "lang": "en"},
+	}
+	OK, err = c.PutWithOptions(bucket, key, value, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	opts.Replace = true
+	OK, err = c.PutWithOptions(bucket, key, value, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	OK, info, err = c.Stat(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, int64(2), info.Version)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Equal(t, "identity", info.ContentEncoding)
+	assert.Equal(t, `"v2"`, info.ETag)
+	assert.Equal(t, opts.Metadata, info.Metadata)
+
+	// Readers return the metadata
+	OK, r, err := c.GetReader(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, opts.Metadata, r.Stat().Metadata)
+	r.Close()
+
+	// Replacing a value replaces its metadata
+	err = c.Replace(bucket, key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	OK, info, err = c.Stat(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, "", info.ContentType)
+	assert.Nil(t, info.Metadata)
+
+	// Expired and missing items are not found
+	OK, err = c.PutWithOptions(bucket, "expired", value, PutOptions{TTL: time.Millisecond, ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	time.Sleep(10 * time.Millisecond)
+	OK, _, err = c.Stat(bucket, "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	OK, _, err = c.Stat(bucket, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	_, _, err = c.Stat(bucket, "")
+	assert.True(t, errors.Is(err, ErrEmptyKey))
+}
+
+func TestTags(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	value := []byte("test value")
+	// Tagged items in several buckets, over more than one page
+	tagged := map[string][]string{}
+	for _, b := range []string{bucket, "testbucket2"} {
+		for n := 0; n < invalidatePageSize+10; n++ {
+			k := fmt.Sprintf("%s%d", key, n)
+			tags := []string{"tenant:1"}
+			if n%2 == 0 {
+				tags = append(tags, "build:abc", "build:abc")
+			}
+			OK, err := c.PutWithOptions(b, k, value, PutOptions{Tags: tags})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, OK)
+			if n%2 == 0 {
+				tagged[b] = append(tagged[b], k)
+			}
+		}
+	}
+	OK, info, err := c.Stat(bucket, key+"0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, []string{"build:abc", "tenant:1"}, info.Tags)
+
+	// Replacing an item replaces its tags
+	OK, err = c.PutWithOptions(bucket, key+"2", value, PutOptions{Replace: true, Tags: []string{"tenant:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+
+	count, err := c.InvalidateTag("build:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(tagged[bucket])+len(tagged["testbucket2"])-1, count)
+	for b, keys := range tagged {
+		for _, k := range keys {
+			OK, err := c.Exists(b, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, b == bucket && k == key+"2", OK)
+			if OK {
+				continue
+			}
+			// The tags of deleted items are deleted, so a new item with the same key is not tagged
+			tags, err := c.DB.GetTags(b, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Empty(t, tags)
+		}
+	}
+	count, err = c.InvalidateTag("build:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, count)
+
+	// Deleting a bucket deletes its tags
+	err = c.DeleteBucket("testbucket2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = c.InvalidateTag("tenant:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, invalidatePageSize+10-len(tagged[bucket])+1, count)
+	keys, err := c.AllKeys(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, keys)
+
+	_, err = c.PutWithOptions(bucket, key, value, PutOptions{Tags: []string{""}})
+	assert.Error(t, err)
+	_, err = c.InvalidateTag("")
+	assert.Error(t, err)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		EvictionPolicy: LFU{},
+		BucketEvictionPolicies: map[string]EvictionPolicy{
+			"sizeaware": SizeAware{},
+			"gds":       GreedyDualSize{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	put := func(b, k string, size int, gets int) {
+		OK, err := c.Put(b, k, bytes.Repeat([]byte("0"), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, OK)
+		for n := 0; n < gets; n++ {
+			_, err = c.Get(b, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	prune := func(b string, targetSize int64, expected []string) {
+		err := c.PruneToSize(b, targetSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := c.AllKeys(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		assert.Equal(t, expected, keys)
+	}
+
+	// LFU is the default policy, so the least used items are evicted first, even if they were used most recently
+	put(bucket, "a", 10, 3)
+	put(bucket, "b", 10, 1)
+	put(bucket, "c", 10, 0)
+	_, err = c.Get(bucket, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prune(bucket, 20, []string{"a", "b"})
+	prune(bucket, 10, []string{"a"})
+
+	// SizeAware evicts the largest cold items first
+	put("sizeaware", "small", 10, 0)
+	put("sizeaware", "large", 100, 1)
+	put("sizeaware", "medium", 50, 0)
+	time.Sleep(10 * time.Millisecond)
+	prune("sizeaware", 60, []string{"medium", "small"})
+	prune("sizeaware", 50, []string{"small"})
+
+	// GreedyDualSize evicts the items with the lowest access count per byte first
+	put("gds", "small", 10, 0)
+	put("gds", "large", 100, 5)
+	put("gds", "used", 10, 5)
+	prune("gds", 20, []string{"small", "used"})
+	prune("gds", 10, []string{"used"})
+}
+
+func TestMaxSize(t *testing.T) {
+	c, err := OpenWithOptions(cachePath, Options{
+		MaxSize:  100,
+		MaxItems: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	put := func(b, k string, size int) error {
+		// Sleep so that each item has a different access time
+		time.Sleep(5 * time.Millisecond)
+		_, err := c.Put(b, k, bytes.Repeat([]byte("0"), size))
+		return err
+	}
+	exists := func(b string, k string) bool {
+		OK, err := c.Exists(b, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return OK
+	}
+	checkStats := func(count, size int64) {
+		s, err := c.DB.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, count, s.Count)
+		assert.Equal(t, size, s.Size)
+		dbSize, err := c.DB.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, size, dbSize)
+	}
+
+	// The least recently used items are evicted across buckets when MaxItems is reached
+	for n := 0; n < 5; n++ {
+		b := bucket
+		if n%2 == 1 {
+			b = "testbucket2"
+		}
+		err = put(b, fmt.Sprintf("k%d", n), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStats(5, 50)
+	time.Sleep(5 * time.Millisecond)
+	_, err = c.Get(bucket, "k0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = put(bucket, "k5", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, exists(bucket, "k0"))
+	assert.False(t, exists("testbucket2", "k1"))
+	checkStats(5, 50)
+
+	// Items are evicted until a larger item fits within MaxSize, but pinned items are not evicted
+	time.Sleep(5 * time.Millisecond)
+	OK, r, err := c.GetReader(bucket, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	err = put(bucket, "large", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	assert.True(t, exists(bucket, "k2"))
+	assert.True(t, exists(bucket, "large"))
+	checkStats(3, 100)
+
+	// Replacing an item only needs room for the difference in size, so only k5 is evicted
+	err = c.Replace(bucket, "large", bytes.Repeat([]byte("0"), 90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(2, 100)
+	assert.False(t, exists(bucket, "k5"))
+	assert.True(t, exists(bucket, "k2"))
+
+	// Values larger than MaxSize are rejected
+	err = put(bucket, "toolarge", 101)
+	assert.True(t, errors.Is(err, ErrCacheFull))
+	checkStats(2, 100)
+
+	// The stats are kept by the database, and can be recounted
+	err = c.DeleteBucket(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(0, 0)
+	err = c.DB.RecountStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(0, 0)
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Puts over the limits can be rejected instead
+	c, err = OpenWithOptions(cachePath, Options{
+		MaxItems:      2,
+		RejectOverMax: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		err = put(bucket, fmt.Sprintf("k%d", n), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = put(bucket, "k2", 10)
+	assert.True(t, errors.Is(err, ErrCacheFull))
+	_, err = c.PutWithReader(bucket, "k2", bytes.NewReader([]byte("value")), SizeUnknown)
+	assert.True(t, errors.Is(err, ErrCacheFull))
+	assert.False(t, exists(bucket, "k2"))
+	err = c.Replace(bucket, "k1", []byte("new value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(2, 19)
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MaxSize limits the stored size, so compressed values that are larger than MaxSize fit.
+	// Each value is stored in 29 bytes, so only k0 is evicted.
+	c, err = OpenWithOptions(cachePath, Options{
+		MaxSize:      100,
+		BucketCodecs: map[string]string{"compressed": codec.Gzip},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 3; n++ {
+		err = put("compressed", fmt.Sprintf("k%d", n), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := c.DB.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(4), s.Count)
+	assert.Equal(t, int64(96), s.StoredSize)
+	assert.Equal(t, int64(3009), s.Size)
+	assert.False(t, exists(bucket, "k0"))
+	assert.True(t, exists(bucket, "k1"))
+}
+
+func TestBucketConfig(t *testing.T) {
+	c, err := Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.DeleteCache()
+	}()
+
+	OK, _, err := c.GetBucketConfig(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+	cfg := BucketConfig{
+		MaxItems:    2,
+		MaxItemSize: 20,
+		DefaultTTL:  time.Hour,
+	}
+	err = c.SetBucketConfig(bucket, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetBucketConfig(bucket, BucketConfig{MaxSize: -1})
+	assert.Error(t, err)
+
+	// The configuration is persisted
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	OK, outCfg, err := c.GetBucketConfig(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.Equal(t, cfg, outCfg)
+
+	value := bytes.Repeat([]byte("0"), 10)
+	put := func(b, k string) error {
+		// Sleep so that each item has a different access time
+		time.Sleep(5 * time.Millisecond)
+		_, err := c.Put(b, k, value)
+		return err
+	}
+	exists := func(b string, k string) bool {
+		OK, err := c.Exists(b, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return OK
+	}
+
+	// Puts over the quota are rejected, and items are given the default TTL
+	for _, k := range []string{"a", "b"} {
+		err = put(bucket, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	OK, info, err := c.Stat(bucket, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, OK)
+	assert.False(t, info.ExpiresAt.IsZero())
+	err = put(bucket, "c")
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.False(t, exists(bucket, "c"))
+	err = c.Replace(bucket, "a", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = put("testbucket2", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Remove(bucket, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Put(bucket, "large", bytes.Repeat([]byte("0"), 21))
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	_, err = c.PutWithReader(bucket, "large", bytes.NewReader(bytes.Repeat([]byte("0"), 21)), SizeUnknown)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.False(t, exists(bucket, "large"))
+
+	// Items are evicted from the bucket if the configuration allows it
+	err = c.SetBucketConfig(bucket, BucketConfig{MaxSize: 30, Evict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b", "c", "d"} {
+		err = put(bucket, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.False(t, exists(bucket, "a"))
+	assert.True(t, exists(bucket, "b"))
+	assert.True(t, exists(bucket, "c"))
+	assert.True(t, exists(bucket, "d"))
+	assert.True(t, exists("testbucket2", "c"))
+	size, err := c.DB.BucketSize(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(30), size)
+
+	// The zero configuration removes the limits
+	err = c.SetBucketConfig(bucket, BucketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	OK, _, err = c.GetBucketConfig(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, OK)
+}
@@ -0,0 +1,298 @@
+package calmcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/imclaren/calmcache/blobstore"
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+const (
+	// checkPageSize is the number of database items that are loaded at a time by Check
+	checkPageSize = 1000
+)
+
+// CheckOptions are the options used by Check
+type CheckOptions struct {
+	// Repair repairs the problems that are found.  Dangling rows, orphan files and temporary files are deleted,
+	// and item sizes are updated to match the file sizes (see CheckReport.SizeMismatches).
+	Repair bool
+	// Reindex adds orphan files to the database instead of deleting them when Repair is true.
+	// Orphan files that are not at the expected path for their bucket and key are always deleted,
+	// as are orphan files that are stored by key hash, because their keys are not known.
+	Reindex bool
+	// VerifyChecksums reads each blob and verifies the item checksum.  Corrupt items are deleted when Repair is true.
+	VerifyChecksums bool
+}
+
+// CheckIssue is a problem found by Check
+type CheckIssue struct {
+	Bucket   string
+	Key      string
+	Path     string
+	DBSize   int64
+	FileSize int64
+}
+
+// CheckReport is the result of Check
+type CheckReport struct {
+	// Items is the number of database items checked
+	Items int
+	// Files is the number of files (blobs) checked
+	Files int
+	// OrphanFiles are files (blobs) that do not have a database item
+	OrphanFiles []CheckIssue
+	// DanglingRows are database items that do not have a file (blob)
+	DanglingRows []CheckIssue
+	// SizeMismatches are database items with a stored size that is different to the file size.
+	// Repair updates the size of items that are not encoded, and deletes items that are encoded.
+	SizeMismatches []CheckIssue
+	// Corrupt are database items with a checksum that does not match the blob (see CheckOptions.VerifyChecksums)
+	Corrupt []CheckIssue
+	// TempFiles are the names of temporary files (blobs) left behind by interrupted writes
+	TempFiles []string
+	// RefcountMismatches are the hashes of deduplicated values with a reference count that does not match the number of items that use them
+	RefcountMismatches []string
+	// Repaired is the number of problems that were repaired
+	Repaired int
+}
+
+// OK returns true if no problems were found
+func (r CheckReport) OK() bool {
+	return len(r.OrphanFiles) == 0 && len(r.DanglingRows) == 0 && len(r.SizeMismatches) == 0 && len(r.Corrupt) == 0 && len(r.TempFiles) == 0 && len(r.RefcountMismatches) == 0
+}
+
+// Check checks that the database and the blob store (e.g. the file cache) are consistent, and optionally repairs any problems.
+// Use this on startup after an unclean shutdown.  Note that the cache is locked until the check is complete.
+func (c *Cache) Check(ctx context.Context, opts CheckOptions) (report CheckReport, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.FC != nil && c.FC.PreviousLayout() != "" {
+		return report, fmt.Errorf("cache Check error: a layout migration is in progress (see MigrateLayout)")
+	}
+	err = c.checkItems(ctx, opts, &report)
+	if err != nil {
+		return report, err
+	}
+	err = c.checkFiles(ctx, opts, &report)
+	if err != nil {
+		return report, err
+	}
+	err = c.checkRefcounts(opts, &report)
+	if err != nil {
+		return report, err
+	}
+	if opts.Repair {
+		err = c.DB.RecountStats()
+	}
+	return report, err
+}
+
+// checkItems checks that each database item has a blob with the same size
+func (c *Cache) checkItems(ctx context.Context, opts CheckOptions, report *CheckReport) error {
+	lastID := 0
+	for {
+		items, err := c.DB.AllAfterID(lastID, checkPageSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		for _, i := range items {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastID = i.Id
+			report.Items++
+			issue := CheckIssue{Bucket: i.Bucket, Key: i.Key, DBSize: i.Size}
+			info, err := c.Store.Stat(blobLocation(i))
+			if err != nil {
+				if !errors.Is(err, blobstore.ErrNotExist) {
+					return err
+				}
+				report.DanglingRows = append(report.DanglingRows, issue)
+				if opts.Repair {
+					_, err = c.delete(ctx, i.Bucket, i.Key)
+					if err != nil {
+						return err
+					}
+					report.Repaired++
+				}
+				continue
+			}
+			issue.Path = info.Name
+			issue.FileSize = info.Size
+			if info.Size != i.StoredSize {
+				report.SizeMismatches = append(report.SizeMismatches, issue)
+				if opts.Repair {
+					// The size of an encoded value cannot be repaired without decoding it, so encoded items are deleted
+					if !i.Encoded() {
+						err = c.DB.UpdateSize(i.Bucket, i.Key, info.Size)
+					} else {
+						_, err = c.delete(ctx, i.Bucket, i.Key)
+					}
+					if err != nil {
+						return err
+					}
+					report.Repaired++
+				}
+				continue
+			}
+			if opts.VerifyChecksums && i.Checksum != "" {
+				err = c.checkChecksum(i)
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, ErrCorrupt) {
+					return err
+				}
+				report.Corrupt = append(report.Corrupt, issue)
+				if opts.Repair {
+					_, err = c.delete(ctx, i.Bucket, i.Key)
+					if err != nil {
+						return err
+					}
+					report.Repaired++
+				}
+			}
+		}
+	}
+}
+
+// checkChecksum reads an item blob and returns a CorruptError if the checksum does not match
+func (c *Cache) checkChecksum(i cacheitem.Item) error {
+	r, err := c.openValue(i)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	return verifyChecksum(i, h.Sum(nil))
+}
+
+// checkFiles checks that each blob has a database item
+func (c *Cache) checkFiles(ctx context.Context, opts CheckOptions, report *CheckReport) error {
+	return c.Store.List(func(info blobstore.Info) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		report.Files++
+		if info.Temp {
+			report.TempFiles = append(report.TempFiles, info.Name)
+			if opts.Repair {
+				err := c.removeBlob(info)
+				if err != nil {
+					return err
+				}
+				report.Repaired++
+			}
+			return nil
+		}
+		// The blob is in the expected place if the blob store gives it the same name when it is looked up by bucket and key
+		expected := false
+		if info.Bucket == DedupBucket {
+			// Deduplicated values are expected if they have a reference count, and cannot be reindexed
+			b, err := c.DB.GetBlob(info.Key)
+			if err != nil {
+				return err
+			}
+			expectedInfo, err := c.Store.Stat(DedupBucket, info.Key)
+			if err != nil && !errors.Is(err, blobstore.ErrNotExist) {
+				return err
+			}
+			if b != nil && err == nil && expectedInfo.Name == info.Name {
+				return nil
+			}
+		} else if info.Bucket != "" && info.KeyHash != "" {
+			// The key of a blob that is stored by key hash is only known if it has a database item
+			i, err := c.DB.GetItemByKeyHash(info.Bucket, info.KeyHash)
+			if err != nil {
+				return err
+			}
+			if i != nil {
+				expectedInfo, err := c.Store.Stat(i.Bucket, i.Key)
+				if err != nil && !errors.Is(err, blobstore.ErrNotExist) {
+					return err
+				}
+				if err == nil && expectedInfo.Name == info.Name {
+					return nil
+				}
+			}
+		} else if info.Bucket != "" && info.Key != "" {
+			i, err := c.DB.GetItem(info.Bucket, info.Key)
+			if err != nil {
+				return err
+			}
+			expectedInfo, err := c.Store.Stat(info.Bucket, info.Key)
+			if err != nil && !errors.Is(err, blobstore.ErrNotExist) {
+				return err
+			}
+			expected = err == nil && expectedInfo.Name == info.Name
+			if i != nil && expected {
+				return nil
+			}
+		}
+		report.OrphanFiles = append(report.OrphanFiles, CheckIssue{Bucket: info.Bucket, Key: info.Key, Path: info.Name, FileSize: info.Size})
+		if !opts.Repair {
+			return nil
+		}
+		if opts.Reindex && expected {
+			err := c.DB.Insert(cacheitem.New(info.Bucket, info.Key, info.Size, 0, time.Time{}))
+			if err != nil {
+				return err
+			}
+		} else {
+			err := c.removeBlob(info)
+			if err != nil {
+				return err
+			}
+		}
+		report.Repaired++
+		return nil
+	})
+}
+
+// checkRefcounts checks that the reference count of each deduplicated value matches the number of items that use the value
+func (c *Cache) checkRefcounts(opts CheckOptions, report *CheckReport) error {
+	mismatches, err := c.DB.BlobRefcountMismatches()
+	if err != nil {
+		return err
+	}
+	for _, b := range mismatches {
+		report.RefcountMismatches = append(report.RefcountMismatches, b.Hash)
+	}
+	if !opts.Repair || len(mismatches) == 0 {
+		return nil
+	}
+	unreferenced, err := c.DB.FixBlobRefcounts()
+	if err != nil {
+		return err
+	}
+	for _, hash := range unreferenced {
+		err = c.Store.Remove(DedupBucket, hash)
+		if err != nil {
+			return err
+		}
+	}
+	report.Repaired += len(mismatches)
+	return nil
+}
+
+// removeBlob removes a blob found by Check.  File cache files are removed by path, because they may not be in the expected place for their bucket and key.
+func (c *Cache) removeBlob(info blobstore.Info) error {
+	if c.FC != nil {
+		return c.FC.RemoveFile(info.Name)
+	}
+	return c.Store.Remove(info.Bucket, info.Key)
+}
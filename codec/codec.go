@@ -0,0 +1,70 @@
+// Package codec encodes cached values before they are stored, and decodes them when they are read.
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// None stores values without encoding them
+	None = ""
+	// Gzip compresses values using gzip
+	Gzip = "gzip"
+	// Zstd compresses values using zstandard
+	Zstd = "zstd"
+)
+
+// Valid returns an error if the codec name is not supported
+func Valid(name string) error {
+	switch name {
+	case None, Gzip, Zstd:
+		return nil
+	default:
+		return fmt.Errorf("codec error: codec not implemented: %s", name)
+	}
+}
+
+// NewWriter returns a writer that encodes the bytes written to it and writes them to w.
+// The writer must be closed to flush the encoded bytes.  Closing the writer does not close w.
+func NewWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	switch name {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, Valid(name)
+	}
+}
+
+// NewReader returns a reader that decodes the bytes read from r.  Closing the reader does not close r.
+func NewReader(name string, r io.Reader) (io.ReadCloser, error) {
+	switch name {
+	case None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, Valid(name)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"level":"info","msg":"calmcache"}`), 1000)
+	for _, name := range []string{None, Gzip, Zstd} {
+		var buf bytes.Buffer
+		w, err := NewWriter(name, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != None {
+			assert.Less(t, buf.Len(), len(value)/10)
+		}
+		r, err := NewReader(name, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, r.Close())
+		assert.Equal(t, value, out)
+	}
+	assert.NotNil(t, Valid("lz4"))
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		value := make([]byte, size)
+		_, err := rand.Read(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w, err := NewEncryptWriter(key, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(w, bytes.NewReader(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := buf.Bytes()
+		assert.False(t, size > 16 && bytes.Contains(encrypted, value[:16]))
+
+		r, err := NewDecryptReader(key, bytes.NewReader(encrypted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, value, out)
+
+		// Wrong keys, modified values and truncated values are not decrypted
+		r, err = NewDecryptReader(bytes.Repeat([]byte{2}, 32), bytes.NewReader(encrypted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrDecrypt, err)
+		modified := append([]byte{}, encrypted...)
+		modified[len(modified)-1] ^= 1
+		r, err = NewDecryptReader(key, bytes.NewReader(modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrDecrypt, err)
+		if size > ChunkSize {
+			r, err = NewDecryptReader(key, bytes.NewReader(encrypted[:headerLength+1+ChunkSize+16]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ioutil.ReadAll(r)
+			assert.Equal(t, ErrDecrypt, err)
+		}
+	}
+	assert.NotNil(t, ValidKey([]byte("short")))
+}
@@ -0,0 +1,227 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted values are split into chunks that are sealed separately using AES-GCM, so that values can be encrypted and
+// decrypted without holding them in memory.  An encrypted value is a header followed by the sealed chunks:
+//
+//	header: magic (4 bytes) | nonce prefix (8 bytes)
+//	chunk:  final flag (1 byte) | AES-GCM sealed chunk (up to ChunkSize + 16 bytes)
+//
+// The nonce of each chunk is the nonce prefix followed by the chunk number, so chunks cannot be reordered, and the final
+// flag is authenticated, so an encrypted value cannot be truncated at a chunk boundary.
+const (
+	// ChunkSize is the maximum number of plaintext bytes in each encrypted chunk
+	ChunkSize = 64 * 1024
+
+	encryptMagic      = "CCE1"
+	noncePrefixLength = 8
+	headerLength      = len(encryptMagic) + noncePrefixLength
+)
+
+// ErrDecrypt is returned when an encrypted value cannot be authenticated (e.g. the wrong key is used, or the value has been modified)
+var ErrDecrypt = errors.New("codec error: decryption failed")
+
+// ValidKey returns an error if key is not a valid AES key (i.e. 16, 24 or 32 bytes long)
+func ValidKey(key []byte) error {
+	_, err := aes.NewCipher(key)
+	return err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewEncryptWriter returns a writer that encrypts the bytes written to it using key, and writes them to w.
+// The writer must be closed to write the final chunk.  Closing the writer does not close w.
+func NewEncryptWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	ew := &encryptWriter{
+		aead:  aead,
+		w:     w,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 0, ChunkSize),
+	}
+	_, err = io.ReadFull(rand.Reader, ew.nonce[:noncePrefixLength])
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptMagic), ew.nonce[:noncePrefixLength]...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+type encryptWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+	closed  bool
+}
+
+func (ew *encryptWriter) Write(p []byte) (n int, err error) {
+	if ew.closed {
+		return 0, fmt.Errorf("codec error: write to closed encrypt writer")
+	}
+	for len(p) > 0 {
+		// A full chunk is only written when more bytes arrive, because the final chunk must be flagged
+		if len(ew.buf) == ChunkSize {
+			err = ew.writeChunk(false)
+			if err != nil {
+				return n, err
+			}
+		}
+		m := copy(ew.buf[len(ew.buf):ChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.writeChunk(true)
+}
+
+func (ew *encryptWriter) writeChunk(final bool) error {
+	if ew.counter == ^uint32(0) {
+		return fmt.Errorf("codec error: too many chunks")
+	}
+	flag := chunkFlag(final)
+	binary.BigEndian.PutUint32(ew.nonce[noncePrefixLength:], ew.counter)
+	ew.sealed = append(ew.sealed[:0], flag...)
+	ew.sealed = ew.aead.Seal(ew.sealed, ew.nonce, ew.buf, flag)
+	_, err := ew.w.Write(ew.sealed)
+	if err != nil {
+		return err
+	}
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+func chunkFlag(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// NewDecryptReader returns a reader that decrypts the bytes read from r using key.
+// ErrDecrypt is returned if the value cannot be authenticated.
+func NewDecryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerLength)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrDecrypt
+		}
+		return nil, err
+	}
+	if string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, ErrDecrypt
+	}
+	dr := &decryptReader{
+		aead:   aead,
+		r:      r,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, 1+ChunkSize+aead.Overhead()),
+	}
+	copy(dr.nonce, header[len(encryptMagic):])
+	return dr, nil
+}
+
+type decryptReader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	nonce   []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	final   bool
+}
+
+func (dr *decryptReader) Read(p []byte) (n int, err error) {
+	for len(dr.plain) == 0 {
+		if dr.final {
+			return 0, io.EOF
+		}
+		err = dr.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readChunk() error {
+	m, err := io.ReadFull(dr.r, dr.sealed)
+	switch {
+	case err == io.EOF:
+		// The stream ended without a final chunk
+		return ErrDecrypt
+	case err == io.ErrUnexpectedEOF:
+	case err != nil:
+		return err
+	}
+	chunk := dr.sealed[:m]
+	if len(chunk) < 1+dr.aead.Overhead() {
+		return ErrDecrypt
+	}
+	flag := chunk[:1]
+	final := flag[0] == 1
+	if !final && m < len(dr.sealed) {
+		// A chunk that is not final must be full
+		return ErrDecrypt
+	}
+	binary.BigEndian.PutUint32(dr.nonce[noncePrefixLength:], dr.counter)
+	plain, err := dr.aead.Open(chunk[1:1], dr.nonce, chunk[1:], flag)
+	if err != nil {
+		return ErrDecrypt
+	}
+	if final {
+		// There must not be any bytes after the final chunk
+		var extra [1]byte
+		_, err = io.ReadFull(dr.r, extra[:])
+		if err == nil {
+			return ErrDecrypt
+		}
+		if err != io.EOF {
+			return err
+		}
+	}
+	dr.counter++
+	dr.plain = plain
+	dr.final = final
+	return nil
+}
@@ -0,0 +1,20 @@
+package calmcache
+
+import (
+	"context"
+	"io"
+)
+
+// ctxReader is an io.Reader that stops reading when a context is done, so that copies (e.g. io.Copy) are interrupted
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (n int, err error) {
+	err = r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
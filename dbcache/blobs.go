@@ -0,0 +1,126 @@
+package dbcache
+
+import (
+	"database/sql"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// GetBlob returns a deduplicated blob, or nil if the blob does not exist
+func (db *DB) GetBlob(hash string) (b *cacheitem.Blob, err error) {
+	sqlString := "SELECT * FROM blobs WHERE hash = ?"
+	var newBlob cacheitem.Blob
+	err = db.QueryRowx(db.Rebind(sqlString), hash).StructScan(&newBlob)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &newBlob, nil
+}
+
+// AllBlobsAfterHash returns up to limit deduplicated blobs with a hash greater than hash (ordered by hash)
+func (db *DB) AllBlobsAfterHash(hash string, limit int) (blobs []cacheitem.Blob, err error) {
+	sqlString := "SELECT * FROM blobs WHERE hash > ? ORDER BY hash ASC LIMIT ?"
+	err = db.Select(&blobs, db.Rebind(sqlString), hash, limit)
+	return blobs, err
+}
+
+// RetainBlob adds a reference to a deduplicated blob.  The blob is added with a reference count of one if it does not exist.
+func (db *DB) RetainBlob(hash string, size int64) error {
+	sqlString := "INSERT INTO blobs (hash, size, refcount) VALUES (?,?,1) ON CONFLICT (hash) DO UPDATE SET refcount = blobs.refcount + 1"
+	_, err := db.Exec(db.Rebind(sqlString), hash, size)
+	return err
+}
+
+// ReleaseBlob removes a reference to a deduplicated blob, and returns the remaining reference count.
+// The blob is deleted from the database when there are no remaining references.
+func (db *DB) ReleaseBlob(hash string) (refcount int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	sqlString := "UPDATE blobs SET refcount = refcount - 1 WHERE hash = ?"
+	_, err = tx.Exec(db.Rebind(sqlString), hash)
+	if err != nil {
+		return 0, err
+	}
+	sqlString = "SELECT refcount FROM blobs WHERE hash = ?"
+	err = tx.QueryRow(db.Rebind(sqlString), hash).Scan(&refcount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, tx.Commit()
+		}
+		return 0, err
+	}
+	if refcount <= 0 {
+		refcount = 0
+		sqlString = "DELETE FROM blobs WHERE hash = ?"
+		_, err = tx.Exec(db.Rebind(sqlString), hash)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return refcount, tx.Commit()
+}
+
+// BlobRefcountMismatches returns the deduplicated blobs with a reference count that does not match the number of items that use the blob.
+// The Refcount of each returned blob is the number of items that use the blob.
+func (db *DB) BlobRefcountMismatches() (blobs []cacheitem.Blob, err error) {
+	sqlString := `
+		SELECT blobs.hash, blobs.size, blobs.created_at, COUNT(cache.id) AS refcount
+		FROM blobs LEFT JOIN cache ON cache.blob = blobs.hash
+		GROUP BY blobs.hash, blobs.size, blobs.created_at, blobs.refcount
+		HAVING blobs.refcount != COUNT(cache.id)
+		ORDER BY blobs.hash ASC
+	`
+	err = db.Select(&blobs, db.Rebind(sqlString))
+	return blobs, err
+}
+
+// FixBlobRefcounts sets the reference count of each deduplicated blob to the number of items that use the blob,
+// and returns the hashes of the blobs that no longer have any references
+func (db *DB) FixBlobRefcounts() (unreferenced []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	sqlString := "UPDATE blobs SET refcount = (SELECT COUNT(*) FROM cache WHERE cache.blob = blobs.hash)"
+	_, err = tx.Exec(db.Rebind(sqlString))
+	if err != nil {
+		return nil, err
+	}
+	unreferenced, err = deleteUnreferencedBlobs(tx, db)
+	if err != nil {
+		return nil, err
+	}
+	return unreferenced, tx.Commit()
+}
+
+func deleteUnreferencedBlobs(tx *sql.Tx, db *DB) (unreferenced []string, err error) {
+	rows, err := tx.Query("SELECT hash FROM blobs WHERE refcount <= 0")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		unreferenced = append(unreferenced, hash)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	_, err = tx.Exec("DELETE FROM blobs WHERE refcount <= 0")
+	if err != nil {
+		return nil, err
+	}
+	return unreferenced, nil
+}
@@ -0,0 +1,52 @@
+package dbcache
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// GetBucketConfig returns the configuration of a bucket, or nil if the bucket has not been configured
+func (db *DB) GetBucketConfig(bucket string) (cfg *cacheitem.BucketConfig, err error) {
+	return db.GetBucketConfigContext(context.Background(), bucket)
+}
+
+// GetBucketConfigContext is GetBucketConfig with a context.  The query is cancelled if ctx is done.
+func (db *DB) GetBucketConfigContext(ctx context.Context, bucket string) (cfg *cacheitem.BucketConfig, err error) {
+	sqlString := "SELECT * FROM buckets WHERE bucket = ?"
+	var newConfig cacheitem.BucketConfig
+	err = db.QueryRowxContext(ctx, db.Rebind(sqlString), bucket).StructScan(&newConfig)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &newConfig, nil
+}
+
+// SetBucketConfig sets the configuration of a bucket, and replaces any existing configuration
+func (db *DB) SetBucketConfig(cfg cacheitem.BucketConfig) error {
+	sqlString := `
+		INSERT INTO buckets (bucket, max_size, max_items, default_ttl, max_item_size, evict) VALUES (?,?,?,?,?,?)
+		ON CONFLICT (bucket) DO UPDATE SET max_size = excluded.max_size, max_items = excluded.max_items,
+			default_ttl = excluded.default_ttl, max_item_size = excluded.max_item_size, evict = excluded.evict
+	`
+	_, err := db.Exec(db.Rebind(sqlString),
+		cfg.Bucket,
+		cfg.MaxSize,
+		cfg.MaxItems,
+		int64(cfg.DefaultTTL),
+		cfg.MaxItemSize,
+		cfg.Evict,
+	)
+	return err
+}
+
+// DeleteBucketConfig deletes the configuration of a bucket
+func (db *DB) DeleteBucketConfig(bucket string) error {
+	sqlString := "DELETE FROM buckets WHERE bucket = ?"
+	_, err := db.Exec(db.Rebind(sqlString), bucket)
+	return err
+}
@@ -4,20 +4,20 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"sync"
 
 	"github.com/imclaren/sqldb"
 	"github.com/imclaren/sqldb/sqlite"
 )
 
-// DB is the cache sql database struct
+// DB is the cache sql database struct.
+// Statements are not serialised by the DB, so that connections can be used concurrently.  Statements that must see each other's
+// changes run in one transaction.  Sqlite databases are configured so that sqlite serialises concurrent writers (see configureSqlite).
 type DB struct {
-	sync.RWMutex
 	*sqldb.DB
 }
 
 // Init opens the cache sql database and creates the database tables if they do not already exist
-func Init(DBPath string, ctx context.Context, cancel context.CancelFunc) (DB, error) {
+func Init(DBPath string, ctx context.Context, cancel context.CancelFunc) (*DB, error) {
 	DB, err := Open(DBPath, ctx, cancel)
 	if err != nil {
 		return DB, err
@@ -27,123 +27,108 @@ func Init(DBPath string, ctx context.Context, cancel context.CancelFunc) (DB, er
 }
 
 // Open opens the cache sql database 
-func Open(DBPath string, ctx context.Context, cancel context.CancelFunc) (DB, error) {
+func Open(DBPath string, ctx context.Context, cancel context.CancelFunc) (*DB, error) {
 	connectString := sqlite.ConnectString(DBPath, "UTC")
 	return initDB(ctx, cancel, "sqlite", connectString)
 }
 
-func initDB(ctx context.Context, cancelFunc context.CancelFunc, dbType, connectString string) (DB, error) {
-	db, err := sqldb.Init(ctx, cancelFunc, dbType, connectString)
+// InitWithDSN opens a cache sql database of type dbType (i.e. "sqlite" or "postgres") using the dsn connect string,
+// and creates the database tables if they do not already exist
+func InitWithDSN(dbType, dsn string, ctx context.Context, cancel context.CancelFunc) (*DB, error) {
+	DB, err := OpenWithDSN(dbType, dsn, ctx, cancel)
 	if err != nil {
-		return DB{}, err
+		return DB, err
 	}
-	return DB{
-		sync.RWMutex{}, &db,
-	}, nil
+	err = DB.CreateTable()
+	return DB, err
 }
 
-// CreateTable creates the database table
-func (db *DB) CreateTable() error {
-	db.Lock()
-	defer db.Unlock()
+// OpenWithDSN opens a cache sql database of type dbType (i.e. "sqlite" or "postgres") using the dsn connect string
+func OpenWithDSN(dbType, dsn string, ctx context.Context, cancel context.CancelFunc) (*DB, error) {
+	switch dbType {
+	case "sqlite", "postgres":
+	default:
+		return nil, fmt.Errorf("Open error: database type not implemented: %s", dbType)
+	}
+	return initDB(ctx, cancel, dbType, dsn)
+}
 
-	switch db.Type {
-	case "sqlite":
-		_, err := db.Exec(`
-    		CREATE TABLE IF NOT EXISTS cache (
-	    		id INTEGER PRIMARY KEY,
-	    		bucket TEXT,
-	    		key TEXT,
-	    		size INT,
-	    		access_count INT,
-	    		expires_at TIMESTAMP,
-				created_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
-			    updated_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))	    		
-    			)
-    		`)
+func initDB(ctx context.Context, cancelFunc context.CancelFunc, dbType, connectString string) (*DB, error) {
+	db, err := sqldb.Init(ctx, cancelFunc, dbType, connectString)
+	if err != nil {
+		return nil, err
+	}
+	if dbType == "sqlite" {
+		db, err = configureSqlite(ctx, cancelFunc, db, connectString)
 		if err != nil {
-			return err
-		}
-		// Create updated_at trigger for cache table
-		_, err = db.Exec(`
-			CREATE TRIGGER [update_cache_updated_at]
-			    AFTER UPDATE
-			    ON cache
-			BEGIN
-			    UPDATE cache SET updated_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW') WHERE id=NEW.id;
-			END;
-		`)
-		if err != nil && err.Error() != "trigger [update_cache_updated_at] already exists" {
-			return err
+			return nil, err
 		}
-	case "postgres":
-		_, err := db.Exec(`
-			CREATE TABLE IF NOT EXISTS cache (
-				id BIGSERIAL PRIMARY KEY, 
-				bucket TEXT,
-				key TEXT, 
-				size BIGINT, 
-				access_count BIGINT, 
-				expires_at TIMESTAMP, 
-				created_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
-			    updated_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP
-			)
-		`)
-		if err != nil {
-			return err
+	}
+	return &DB{
+		&db,
+	}, nil
+}
+
+// sqliteDriverName is the name of the go-sqlite3 driver, which is the only sqlite driver that understands sqliteParams
+const sqliteDriverName = "sqlite3"
+
+// configureSqlite configures a sqlite database so that concurrent writers wait for each other instead of failing.
+// If the database uses the go-sqlite3 driver, it is reopened with sqliteParams, so that each pooled connection is configured.
+// Other drivers may not understand sqliteParams, so the database is limited to one connection, which is given a busy timeout
+// (for writers in other processes) and write-ahead logging (which is kept by the database file) using pragmas.
+func configureSqlite(ctx context.Context, cancelFunc context.CancelFunc, db sqldb.DB, connectString string) (sqldb.DB, error) {
+	if db.DriverName() == sqliteDriverName {
+		paramsConnectString := sqliteConnectString(connectString)
+		if paramsConnectString == connectString {
+			return db, nil
 		}
-		// Create or replace update_updated_at_column function
-		// Note we only need to do this once for all of the tables that we update
-		_, err = db.Exec(`
-			CREATE OR REPLACE FUNCTION update_updated_at_column()
-			RETURNS TRIGGER AS $$
-			BEGIN
-			   NEW.updated_at = now(); 
-			   RETURN NEW;
-			END;
-			$$ language 'plpgsql';
-		`)
+		// Close the sql database without cancelling the cache context
+		err := db.DB.DB.Close()
 		if err != nil {
-			return err
-		}
-		// Create updated_at trigger for cache table
-		_, err = db.Exec(`
-			CREATE TRIGGER update_cache_updated_at 
-				BEFORE UPDATE
-				ON cache 
-				FOR EACH ROW 
-				EXECUTE PROCEDURE update_updated_at_column();
-		`)
-		if err != nil && err.Error() != "pq: trigger \"update_cacheupdated_at\" for relation \"cache\" already exists" {
-			return err
+			return db, err
 		}
-	default:
-		return fmt.Errorf("Create table error: database type not implemented: %s", db.Type)
+		return sqldb.Init(ctx, cancelFunc, "sqlite", paramsConnectString)
 	}
+	db.SetMaxOpenConns(1)
+	_, err := db.Exec("PRAGMA busy_timeout = 10000")
+	if err != nil {
+		return db, err
+	}
+	_, err = db.Exec("PRAGMA journal_mode = WAL")
+	return db, err
+}
 
-	// Add indexes
-	indexSlice := []struct {
-		col  string
-		isUnique  bool
-	}{
-		{"key", true},
-		{"size", false},
-		{"access_count", false},
-		//{"expires_at", false},
-		//{"created_at", false},
-		{"updated_at", false},
-	}
-	for _, in := range indexSlice {
-		SQLString, err := indexSQLString(db.Type, "btree", in.isUnique, "cache", []string{in.col}, "")
-		if err != nil {
-			return err
+// sqliteParams are the go-sqlite3 connection parameters that let connections write concurrently.
+// Write-ahead logging lets readers run while a write is in progress, the busy timeout makes writers wait for the database lock
+// instead of failing, and immediate transactions take the lock when they begin, so that a transaction that has read the
+// database does not fail when it writes.
+var sqliteParams = []struct {
+	name  string
+	value string
+}{
+	{"_journal_mode", "WAL"},
+	{"_busy_timeout", "10000"},
+	{"_txlock", "immediate"},
+}
+
+// sqliteConnectString adds sqliteParams to a sqlite connect string, unless they are already set
+func sqliteConnectString(connectString string) string {
+	for _, p := range sqliteParams {
+		if strings.Contains(connectString, p.name+"=") {
+			continue
 		}
-		_, err = db.Exec(SQLString)
-		if err != nil {
-			return err
+		sep := "?"
+		if strings.Contains(connectString, "?") {
+			sep = "&"
 		}
+		connectString += sep + p.name + "=" + p.value
 	}
-	return nil
+	return connectString
+}
+
+// CreateTable creates the database tables if they do not already exist, and upgrades existing tables to the current schema
+func (db *DB) CreateTable() error {
+	return db.Migrate()
 }
 
 func indexSQLString(dbType, indexType string, isUnique bool, tableName string, indexColumns []string, whereString string) (string, error) {
@@ -163,11 +148,32 @@ func indexSQLString(dbType, indexType string, isUnique bool, tableName string, i
 	}
 } 
 
-// DropTable drops the database table
+// DropTable drops the database tables
 func (db *DB) DropTable() error {
-	db.Lock()
-	defer db.Unlock()
-
 	_, err := db.Exec("DROP TABLE IF EXISTS cache")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS meta")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS blobs")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS cache_tags")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS cache_stats")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS buckets")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS schema_version")
 	return err
 }
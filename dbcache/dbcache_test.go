@@ -0,0 +1,74 @@
+package dbcache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imclaren/calmcache/cacheitem"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestConcurrentWriters(t *testing.T) {
+	tempDirName, err := os.MkdirTemp("", "calmcachedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDirName)
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := Init(filepath.Join(tempDirName, "cache.db"), ctx, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Use several connections, so that sqlite serialises the writers
+	db.SetMaxOpenConns(8)
+
+	writers := 8
+	updates := 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("testkey%d", w)
+			err := db.Insert(cacheitem.New("testbucket", key, 3, 0, time.Time{}))
+			if err != nil {
+				errs <- err
+				return
+			}
+			for n := 0; n < updates; n++ {
+				err = db.UpdateAccessCount("testbucket", key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				err = db.Replace(cacheitem.New("testbucket", key, int64(n), 0, time.Time{}))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		i, err := db.GetItem("testbucket", fmt.Sprintf("testkey%d", w))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(updates-1), i.Size)
+		assert.Equal(t, int64(updates), i.AccessCount)
+	}
+}
@@ -1,31 +1,83 @@
 package dbcache
 
+import (
+	"context"
+)
+
 // Delete deletes an item from the database
 func (db *DB) Delete(bucket, key string) error {
-	db.Lock()
-	defer db.Unlock()
+	return db.DeleteContext(context.Background(), bucket, key)
+}
 
+// DeleteContext deletes an item and its tags from the database.  The query is cancelled if ctx is done.
+func (db *DB) DeleteContext(ctx context.Context, bucket, key string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	sqlString := "DELETE FROM cache WHERE bucket = ? AND key = ?"
-	_, err := db.Exec(db.Rebind(sqlString), bucket, key)
-	return err
+	_, err = tx.ExecContext(ctx, db.Rebind(sqlString), bucket, key)
+	if err != nil {
+		return err
+	}
+	sqlString = "DELETE FROM cache_tags WHERE bucket = ? AND key = ?"
+	_, err = tx.ExecContext(ctx, db.Rebind(sqlString), bucket, key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// DeleteBucket deletes all of the items in the bucket
-func (db *DB) DeleteBucket(bucket string) error {
-	db.Lock()
-	defer db.Unlock()
-
-	sqlString := "DELETE FROM cache WHERE bucket = ?"
-	_, err := db.Exec(db.Rebind(sqlString), bucket)
-	return err
+// DeleteBucket deletes all of the items in the bucket and their tags, and removes the references to deduplicated blobs
+// held by the items, in one transaction.  It returns the hashes of the blobs that no longer have any references.
+func (db *DB) DeleteBucket(bucket string) (unreferenced []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	sqlString := `
+		UPDATE blobs SET refcount = refcount - (
+			SELECT COUNT(*) FROM cache WHERE cache.bucket = ? AND cache.blob = blobs.hash
+		)
+		WHERE hash IN (SELECT blob FROM cache WHERE bucket = ? AND blob != '')
+	`
+	_, err = tx.Exec(db.Rebind(sqlString), bucket, bucket)
+	if err != nil {
+		return nil, err
+	}
+	unreferenced, err = deleteUnreferencedBlobs(tx, db)
+	if err != nil {
+		return nil, err
+	}
+	sqlString = "DELETE FROM cache WHERE bucket = ?"
+	_, err = tx.Exec(db.Rebind(sqlString), bucket)
+	if err != nil {
+		return nil, err
+	}
+	sqlString = "DELETE FROM cache_tags WHERE bucket = ?"
+	_, err = tx.Exec(db.Rebind(sqlString), bucket)
+	if err != nil {
+		return nil, err
+	}
+	return unreferenced, tx.Commit()
 }
 
-// DeleteAll deletes all of the items from the cache
+// DeleteAll deletes all of the rows of the cache tables (i.e. the items, tags, deduplicated blobs, bucket configurations, stats
+// and settings) in one transaction.  The tables and the schema version are kept.
 func (db *DB) DeleteAll() error {
-	db.Lock()
-	defer db.Unlock()
-
-	sqlString := "DELETE FROM cache"
-	_, err := db.Exec(db.Rebind(sqlString))
-	return err
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The stats are deleted after the items, because the stats triggers update them when items are deleted
+	for _, table := range []string{"cache", "cache_tags", "blobs", "buckets", "cache_stats", "meta"} {
+		_, err = tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
\ No newline at end of file
@@ -2,18 +2,38 @@ package dbcache
 
 import "github.com/imclaren/calmcache/cacheitem"
 
-// Insert inserts an item in the database
+// Insert inserts an item and its tags in the database
 func (db *DB) Insert(i cacheitem.Item) error {
-	db.Lock()
-	defer db.Unlock()
-
-	sqlString := "INSERT INTO cache (bucket, key, size, access_count, expires_at) VALUES (?,?,?,?,?)"
-	_, err := db.Exec(db.Rebind(sqlString),
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sqlString := "INSERT INTO cache (bucket, key, size, access_count, expires_at, version, checksum, blob, codec, stored_size, key_id, key_hash, content_type, content_encoding, etag, metadata) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+	_, err = tx.Exec(db.Rebind(sqlString),
 		i.Bucket,
 		i.Key,
 		i.Size,
 		i.AccessCount,
 		i.ExpiresAt,
+		i.Version,
+		i.Checksum,
+		i.Blob,
+		i.Codec,
+		i.StoredSize,
+		i.KeyID,
+		i.KeyHash,
+		i.ContentType,
+		i.ContentEncoding,
+		i.ETag,
+		i.Metadata,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	err = insertTags(tx, db, i.Bucket, i.Key, i.Tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
\ No newline at end of file
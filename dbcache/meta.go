@@ -0,0 +1,44 @@
+package dbcache
+
+import (
+	"database/sql"
+)
+
+// GetMeta gets a cache setting from the meta table.  OK returns false if the setting does not exist.
+func (db *DB) GetMeta(name string) (value string, OK bool, err error) {
+	sqlString := "SELECT value FROM meta WHERE name = ?"
+	err = db.QueryRow(db.Rebind(sqlString), name).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetMeta sets a cache setting in the meta table
+func (db *DB) SetMeta(name, value string) error {
+	sqlString := "INSERT INTO meta (name, value) VALUES (?,?) ON CONFLICT (name) DO UPDATE SET value = excluded.value"
+	_, err := db.Exec(db.Rebind(sqlString), name, value)
+	return err
+}
+
+// InitMeta sets a cache setting in the meta table if it does not exist, and returns the current value of the setting
+func (db *DB) InitMeta(name, value string) (current string, err error) {
+	sqlString := "INSERT INTO meta (name, value) VALUES (?,?) ON CONFLICT (name) DO NOTHING"
+	_, err = db.Exec(db.Rebind(sqlString), name, value)
+	if err != nil {
+		return "", err
+	}
+	sqlString = "SELECT value FROM meta WHERE name = ?"
+	err = db.QueryRow(db.Rebind(sqlString), name).Scan(&current)
+	return current, err
+}
+
+// DeleteMeta deletes a cache setting from the meta table
+func (db *DB) DeleteMeta(name string) error {
+	sqlString := "DELETE FROM meta WHERE name = ?"
+	_, err := db.Exec(db.Rebind(sqlString), name)
+	return err
+}
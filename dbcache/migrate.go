@@ -0,0 +1,572 @@
+package dbcache
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is a database schema change.
+// Migrations are run in version order, and each migration is run once in its own transaction.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx, dbType string) error
+}
+
+// migrations are the database schema changes, in order.  Add new migrations to the end of the slice.
+var migrations = []migration{
+	{1, "create cache table", createCacheTable},
+	{2, "add cache version column", addVersionColumn},
+	{3, "make cache keys unique per bucket", uniqueBucketKeys},
+	{4, "add cache checksum column", addChecksumColumn},
+	{5, "add blobs table for deduplicated values", createBlobsTable},
+	{6, "add cache codec and stored_size columns", addCodecColumns},
+	{7, "add cache key_id column", addKeyIDColumn},
+	{8, "add meta table and cache key_hash column", createMetaTable},
+	{9, "add cache content_type, content_encoding, etag and metadata columns", addMetadataColumns},
+	{10, "add cache_tags table", createTagsTable},
+	{11, "add cache_stats table and triggers", createStatsTable},
+	{12, "add buckets table for bucket configuration", createBucketsTable},
+	{13, "only set cache updated_at when items are accessed or replaced", accessUpdatedAtTrigger},
+}
+
+// migrateLockID is the key of the postgres advisory lock that serialises migrations between processes
+const migrateLockID = 4253100551
+
+// sqliteCacheUpdatedAtTrigger creates the sqlite trigger that sets updated_at when a cache row is updated.
+// This is the trigger created by the first migration, which is replaced by sqliteCacheAccessUpdatedAtTrigger.
+const sqliteCacheUpdatedAtTrigger = `
+	CREATE TRIGGER IF NOT EXISTS [update_cache_updated_at]
+		AFTER UPDATE
+		ON cache
+	BEGIN
+		UPDATE cache SET updated_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW') WHERE id=NEW.id;
+	END;
+`
+
+// sqliteCacheAccessUpdatedAtTrigger creates the sqlite trigger that sets updated_at when the access count or the version of a cache row
+// is updated (i.e. when the item is accessed or replaced), so that other updates (e.g. re-encryption) do not change the last accessed time
+const sqliteCacheAccessUpdatedAtTrigger = `
+	CREATE TRIGGER IF NOT EXISTS [update_cache_updated_at]
+		AFTER UPDATE OF access_count, version
+		ON cache
+	BEGIN
+		UPDATE cache SET updated_at=STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW') WHERE id=NEW.id;
+	END;
+`
+
+// SchemaVersion returns the current version of the database schema
+func (db *DB) SchemaVersion() (version int, err error) {
+	return db.schemaVersion()
+}
+
+func (db *DB) schemaVersion() (version int, err error) {
+	var v sql.NullInt64
+	err = db.Get(&v, "SELECT MAX(version) FROM schema_version")
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// Migrate creates the schema_version table if it does not already exist, and runs any migrations that have not been run.
+// Existing databases are upgraded in place.  Postgres migrations take an advisory lock, and each migration checks the schema version
+// again once it has the lock, so processes that share a database can run Migrate concurrently.
+func (db *DB) Migrate() error {
+	var sqlString string
+	switch db.Type {
+	case "sqlite":
+		sqlString = `
+			CREATE TABLE IF NOT EXISTS schema_version (
+				version INTEGER PRIMARY KEY,
+				description TEXT,
+				applied_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))
+			)
+		`
+	case "postgres":
+		sqlString = `
+			CREATE TABLE IF NOT EXISTS schema_version (
+				version INTEGER PRIMARY KEY,
+				description TEXT,
+				applied_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP
+			)
+		`
+	default:
+		return fmt.Errorf("Migrate error: database type not implemented: %s", db.Type)
+	}
+	err := db.inMigrateTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(sqlString)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	current, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = db.migrate(m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) error: %v", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// migrate runs a migration, unless another process has run it since the schema version was read
+func (db *DB) migrate(m migration) error {
+	return db.inMigrateTx(func(tx *sql.Tx) error {
+		var current sql.NullInt64
+		err := tx.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&current)
+		if err != nil {
+			return err
+		}
+		if current.Int64 >= int64(m.version) {
+			return nil
+		}
+		err = m.up(tx, db.Type)
+		if err != nil {
+			return err
+		}
+		sqlString := "INSERT INTO schema_version (version, description) VALUES (?,?)"
+		_, err = tx.Exec(db.Rebind(sqlString), m.version, m.description)
+		return err
+	})
+}
+
+// inMigrateTx runs fn in a transaction.  Postgres transactions first take the migration advisory lock, which is released
+// when the transaction ends.  Sqlite transactions take the database lock when they begin, or the database
+// has one connection (see configureSqlite), so no lock is taken.
+func (db *DB) inMigrateTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if db.Type == "postgres" {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrateLockID)
+		if err != nil {
+			return err
+		}
+	}
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createCacheTable creates the cache table, the updated_at trigger and the cache indexes
+func createCacheTable(tx *sql.Tx, dbType string) error {
+	switch dbType {
+	case "sqlite":
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS cache (
+				id INTEGER PRIMARY KEY,
+				bucket TEXT,
+				key TEXT,
+				size INT,
+				access_count INT,
+				expires_at TIMESTAMP,
+				created_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')),
+				updated_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))
+			)
+		`)
+		if err != nil {
+			return err
+		}
+		// Create updated_at trigger for cache table
+		_, err = tx.Exec(sqliteCacheUpdatedAtTrigger)
+		if err != nil {
+			return err
+		}
+	case "postgres":
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS cache (
+				id BIGSERIAL PRIMARY KEY,
+				bucket TEXT,
+				key TEXT,
+				size BIGINT,
+				access_count BIGINT,
+				expires_at TIMESTAMP,
+				created_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP
+			)
+		`)
+		if err != nil {
+			return err
+		}
+		// Create or replace update_updated_at_column function
+		// Note we only need to do this once for all of the tables that we update
+		_, err = tx.Exec(`
+			CREATE OR REPLACE FUNCTION update_updated_at_column()
+			RETURNS TRIGGER AS $$
+			BEGIN
+			   NEW.updated_at = now();
+			   RETURN NEW;
+			END;
+			$$ language 'plpgsql';
+		`)
+		if err != nil {
+			return err
+		}
+		// Create updated_at trigger for cache table
+		_, err = tx.Exec("DROP TRIGGER IF EXISTS update_cache_updated_at ON cache")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			CREATE TRIGGER update_cache_updated_at
+				BEFORE UPDATE
+				ON cache
+				FOR EACH ROW
+				EXECUTE PROCEDURE update_updated_at_column();
+		`)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Create table error: database type not implemented: %s", dbType)
+	}
+
+	// Add indexes
+	indexSlice := []struct {
+		col      string
+		isUnique bool
+	}{
+		{"key", true},
+		{"size", false},
+		{"access_count", false},
+		//{"expires_at", false},
+		//{"created_at", false},
+		{"updated_at", false},
+	}
+	for _, in := range indexSlice {
+		err := createIndex(tx, dbType, in.isUnique, "cache", []string{in.col})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addVersionColumn adds the version column used by compare and swap
+func addVersionColumn(tx *sql.Tx, dbType string) error {
+	return addColumn(tx, dbType, "cache", "version", "INT DEFAULT 1", "BIGINT DEFAULT 1")
+}
+
+// uniqueBucketKeys replaces the unique key index with a unique (bucket, key) index, so that the same key can be used in different buckets
+func uniqueBucketKeys(tx *sql.Tx, dbType string) error {
+	_, err := tx.Exec("DROP INDEX IF EXISTS cache_key_idx")
+	if err != nil {
+		return err
+	}
+	return createIndex(tx, dbType, true, "cache", []string{"bucket", "key"})
+}
+
+// addChecksumColumn adds the column for the hex encoded SHA-256 checksum of each item.  Existing items have an empty checksum.
+func addChecksumColumn(tx *sql.Tx, dbType string) error {
+	return addColumn(tx, dbType, "cache", "checksum", "TEXT DEFAULT ''", "TEXT DEFAULT ''")
+}
+
+// createBlobsTable creates the blobs table, which holds the reference counts of deduplicated values,
+// and adds the cache blob column, which holds the hash of the deduplicated value used by an item, or an empty string if the value is not deduplicated
+func createBlobsTable(tx *sql.Tx, dbType string) error {
+	var sqlString string
+	switch dbType {
+	case "sqlite":
+		sqlString = `
+			CREATE TABLE IF NOT EXISTS blobs (
+				hash TEXT PRIMARY KEY,
+				size INT,
+				refcount INT,
+				created_at TIMESTAMP NULL DEFAULT(STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW'))
+			)
+		`
+	case "postgres":
+		sqlString = `
+			CREATE TABLE IF NOT EXISTS blobs (
+				hash TEXT PRIMARY KEY,
+				size BIGINT,
+				refcount BIGINT,
+				created_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP
+			)
+		`
+	default:
+		return fmt.Errorf("Create blobs table error: database type not implemented: %s", dbType)
+	}
+	_, err := tx.Exec(sqlString)
+	if err != nil {
+		return err
+	}
+	err = addColumn(tx, dbType, "cache", "blob", "TEXT DEFAULT ''", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	return createIndex(tx, dbType, false, "cache", []string{"blob"})
+}
+
+// addCodecColumns adds the cache codec column, which holds the codec used to encode an item value, and the cache stored_size column,
+// which holds the size of the encoded value.  The stored size of existing items is their size.
+func addCodecColumns(tx *sql.Tx, dbType string) error {
+	err := addColumn(tx, dbType, "cache", "codec", "TEXT DEFAULT ''", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(tx, dbType, "cache", "stored_size", "INT DEFAULT 0", "BIGINT DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	// The updated_at trigger is replaced first, so that setting the stored size does not change the last accessed time of items
+	err = accessUpdatedAtTrigger(tx, dbType)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE cache SET stored_size = size")
+	return err
+}
+
+// addKeyIDColumn adds the cache key_id column, which holds the ID of the key used to encrypt an item value, or an empty string if the value is not encrypted
+func addKeyIDColumn(tx *sql.Tx, dbType string) error {
+	return addColumn(tx, dbType, "cache", "key_id", "TEXT DEFAULT ''", "TEXT DEFAULT ''")
+}
+
+// createMetaTable creates the meta table, which holds cache settings (e.g. the file cache layout), and adds the cache key_hash column,
+// which holds the hash of each key so that files stored by key hash can be matched to items.
+// Caches that already contain items use the legacy file cache layout.  Note that the key hash of existing items is not set.
+func createMetaTable(tx *sql.Tx, dbType string) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS meta (
+			name TEXT PRIMARY KEY,
+			value TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	err = addColumn(tx, dbType, "cache", "key_hash", "TEXT DEFAULT ''", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = createIndex(tx, dbType, false, "cache", []string{"bucket", "key_hash"})
+	if err != nil {
+		return err
+	}
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM cache").Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	_, err = tx.Exec("INSERT INTO meta (name, value) VALUES ('layout', 'legacy') ON CONFLICT (name) DO NOTHING")
+	return err
+}
+
+// addMetadataColumns adds the columns that hold the content type, content encoding, ETag and JSON encoded user metadata of each item
+func addMetadataColumns(tx *sql.Tx, dbType string) error {
+	for _, col := range []string{"content_type", "content_encoding", "etag", "metadata"} {
+		err := addColumn(tx, dbType, "cache", col, "TEXT DEFAULT ''", "TEXT DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTagsTable creates the cache_tags table, which holds the tags of each item.  Tags are indexed by item so that they can be deleted with the item.
+func createTagsTable(tx *sql.Tx, dbType string) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS cache_tags (
+			tag TEXT,
+			bucket TEXT,
+			key TEXT,
+			PRIMARY KEY (tag, bucket, key)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return createIndex(tx, dbType, false, "cache_tags", []string{"bucket", "key"})
+}
+
+// createStatsTable creates the cache_stats table, which holds the number, total size and total stored size of the items in each bucket,
+// and the triggers that update it when items are inserted, resized or deleted, so that the cache and bucket sizes are not summed on each put.
+func createStatsTable(tx *sql.Tx, dbType string) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS cache_stats (
+			bucket TEXT PRIMARY KEY,
+			item_count BIGINT DEFAULT 0,
+			size BIGINT DEFAULT 0,
+			stored_size BIGINT DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	switch dbType {
+	case "sqlite":
+		_, err = tx.Exec(`
+			CREATE TRIGGER IF NOT EXISTS [insert_cache_stats]
+				AFTER INSERT
+				ON cache
+			BEGIN
+				INSERT INTO cache_stats (bucket) VALUES (NEW.bucket) ON CONFLICT (bucket) DO NOTHING;
+				UPDATE cache_stats SET item_count = item_count + 1, size = size + COALESCE(NEW.size, 0), stored_size = stored_size + COALESCE(NEW.stored_size, 0)
+					WHERE bucket = NEW.bucket;
+			END;
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			CREATE TRIGGER IF NOT EXISTS [update_cache_stats]
+				AFTER UPDATE OF size, stored_size
+				ON cache
+			BEGIN
+				UPDATE cache_stats SET size = size - COALESCE(OLD.size, 0) + COALESCE(NEW.size, 0),
+					stored_size = stored_size - COALESCE(OLD.stored_size, 0) + COALESCE(NEW.stored_size, 0)
+					WHERE bucket = NEW.bucket;
+			END;
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			CREATE TRIGGER IF NOT EXISTS [delete_cache_stats]
+				AFTER DELETE
+				ON cache
+			BEGIN
+				UPDATE cache_stats SET item_count = item_count - 1, size = size - COALESCE(OLD.size, 0), stored_size = stored_size - COALESCE(OLD.stored_size, 0)
+					WHERE bucket = OLD.bucket;
+			END;
+		`)
+		if err != nil {
+			return err
+		}
+	case "postgres":
+		_, err = tx.Exec(`
+			CREATE OR REPLACE FUNCTION update_cache_stats()
+			RETURNS TRIGGER AS $$
+			BEGIN
+				IF TG_OP = 'INSERT' THEN
+					INSERT INTO cache_stats (bucket) VALUES (NEW.bucket) ON CONFLICT (bucket) DO NOTHING;
+					UPDATE cache_stats SET item_count = item_count + 1, size = size + COALESCE(NEW.size, 0), stored_size = stored_size + COALESCE(NEW.stored_size, 0)
+						WHERE bucket = NEW.bucket;
+				ELSIF TG_OP = 'UPDATE' THEN
+					UPDATE cache_stats SET size = size - COALESCE(OLD.size, 0) + COALESCE(NEW.size, 0),
+						stored_size = stored_size - COALESCE(OLD.stored_size, 0) + COALESCE(NEW.stored_size, 0)
+						WHERE bucket = NEW.bucket;
+				ELSE
+					UPDATE cache_stats SET item_count = item_count - 1, size = size - COALESCE(OLD.size, 0), stored_size = stored_size - COALESCE(OLD.stored_size, 0)
+						WHERE bucket = OLD.bucket;
+				END IF;
+				RETURN NULL;
+			END;
+			$$ language 'plpgsql';
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DROP TRIGGER IF EXISTS update_cache_stats ON cache")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			CREATE TRIGGER update_cache_stats
+				AFTER INSERT OR UPDATE OF size, stored_size OR DELETE
+				ON cache
+				FOR EACH ROW
+				EXECUTE PROCEDURE update_cache_stats();
+		`)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Create table error: database type not implemented: %s", dbType)
+	}
+	return recountStats(tx)
+}
+
+// createBucketsTable creates the buckets table, which holds the configuration (i.e. quotas and default TTL) of each bucket.
+// The default TTL is stored in nanoseconds.
+func createBucketsTable(tx *sql.Tx, dbType string) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS buckets (
+			bucket TEXT PRIMARY KEY,
+			max_size BIGINT DEFAULT 0,
+			max_items BIGINT DEFAULT 0,
+			default_ttl BIGINT DEFAULT 0,
+			max_item_size BIGINT DEFAULT 0,
+			evict BOOLEAN DEFAULT FALSE
+		)
+	`)
+	return err
+}
+
+// accessUpdatedAtTrigger replaces the cache updated_at trigger with a trigger that only sets updated_at when the access count or
+// the version of an item is updated (i.e. when the item is accessed or replaced).  Other updates (e.g. re-encryption, key hashes
+// and size repairs) do not change the last accessed time of items, and do not need to disable the trigger.
+func accessUpdatedAtTrigger(tx *sql.Tx, dbType string) error {
+	switch dbType {
+	case "sqlite":
+		_, err := tx.Exec("DROP TRIGGER IF EXISTS update_cache_updated_at")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqliteCacheAccessUpdatedAtTrigger)
+		return err
+	case "postgres":
+		_, err := tx.Exec("DROP TRIGGER IF EXISTS update_cache_updated_at ON cache")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			CREATE TRIGGER update_cache_updated_at
+				BEFORE UPDATE OF access_count, version
+				ON cache
+				FOR EACH ROW
+				EXECUTE PROCEDURE update_updated_at_column();
+		`)
+		return err
+	default:
+		return fmt.Errorf("Migrate error: database type not implemented: %s", dbType)
+	}
+}
+
+func createIndex(tx *sql.Tx, dbType string, isUnique bool, tableName string, indexColumns []string) error {
+	SQLString, err := indexSQLString(dbType, "btree", isUnique, tableName, indexColumns, "")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(SQLString)
+	return err
+}
+
+// addColumn adds a column to a table if the column does not already exist.
+// The column definitions can be different for sqlite and postgres.
+func addColumn(tx *sql.Tx, dbType, tableName, columnName, sqliteDef, postgresDef string) error {
+	switch dbType {
+	case "sqlite":
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", tableName, columnName).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, columnName, sqliteDef))
+		return err
+	case "postgres":
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", tableName, columnName, postgresDef))
+		return err
+	default:
+		return fmt.Errorf("Add column error: database type not implemented: %s", dbType)
+	}
+}
@@ -0,0 +1,303 @@
+package dbcache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imclaren/calmcache/cacheitem"
+	"github.com/imclaren/sqldb"
+	"github.com/jmoiron/sqlx"
+	assert "github.com/stretchr/testify/require"
+)
+
+// fakePostgresDriver is a database/sql driver that records the statements that it is sent instead of running them.
+// It is used with the postgres database type, so that the postgres statements are tested without a postgres server.
+// Queries return no rows, except for the schema version (the highest version inserted into schema_version) and counts, which are zero.
+type fakePostgresDriver struct {
+	sync.Mutex
+	statements []fakeStatement
+	version    int64
+}
+
+// fakeStatement is a statement recorded by fakePostgresDriver.  Transactions are recorded as BEGIN, COMMIT and ROLLBACK.
+type fakeStatement struct {
+	query string
+	args  []driver.NamedValue
+}
+
+var fakePostgres = &fakePostgresDriver{}
+
+func init() {
+	sql.Register("fakepostgres", fakePostgres)
+}
+
+// openFakePostgres returns a postgres cache database that uses fakePostgresDriver, and resets the recorded statements
+func openFakePostgres(t *testing.T) *DB {
+	fakePostgres.Lock()
+	fakePostgres.statements = nil
+	fakePostgres.version = 0
+	fakePostgres.Unlock()
+
+	sqlDB, err := sql.Open("fakepostgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sqlDB.Close()
+	})
+	return &DB{DB: &sqldb.DB{DB: sqlx.NewDb(sqlDB, "postgres"), Type: "postgres"}}
+}
+
+// recorded returns the statements that have been recorded since the database was opened
+func (d *fakePostgresDriver) recorded() []fakeStatement {
+	d.Lock()
+	defer d.Unlock()
+
+	return append([]fakeStatement{}, d.statements...)
+}
+
+func (d *fakePostgresDriver) record(query string, args []driver.NamedValue) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.statements = append(d.statements, fakeStatement{query, args})
+	if strings.HasPrefix(query, "INSERT INTO schema_version") {
+		d.version = args[0].Value.(int64)
+	}
+}
+
+func (d *fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakePostgresDriver
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fake postgres: prepared statements are not supported")
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.d.record("BEGIN", nil)
+	return fakeTx{c.d}, nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.record(query, args)
+	if strings.Contains(query, "MAX(version) FROM schema_version") {
+		c.d.Lock()
+		defer c.d.Unlock()
+		return &fakeRows{columns: []string{"max"}, values: [][]driver.Value{{c.d.version}}}, nil
+	}
+	if strings.HasPrefix(query, "SELECT COUNT(") {
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeTx struct {
+	d *fakePostgresDriver
+}
+
+func (tx fakeTx) Commit() error {
+	tx.d.record("COMMIT", nil)
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.d.record("ROLLBACK", nil)
+	return nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var (
+	postgresPlaceholder = regexp.MustCompile(`\$(\d+)`)
+	// sqliteSyntax matches sqlite syntax that postgres does not support
+	sqliteSyntax = regexp.MustCompile(`(?i)\?|STRFTIME|AUTOINCREMENT|INSERT OR (REPLACE|IGNORE)|IF NOT EXISTS \[|DATETIME\(`)
+)
+
+// checkPostgresStatements checks that the statements use postgres placeholders for all of their arguments, and no sqlite syntax
+func checkPostgresStatements(t *testing.T, statements []fakeStatement) {
+	for _, s := range statements {
+		assert.False(t, sqliteSyntax.MatchString(s.query), s.query)
+		placeholders := 0
+		for _, m := range postgresPlaceholder.FindAllStringSubmatch(s.query, -1) {
+			var n int
+			fmt.Sscan(m[1], &n)
+			if n > placeholders {
+				placeholders = n
+			}
+		}
+		assert.Equal(t, len(s.args), placeholders, s.query)
+	}
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	db := openFakePostgres(t)
+
+	err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, migrations[len(migrations)-1].version, version)
+
+	statements := fakePostgres.recorded()
+	checkPostgresStatements(t, statements)
+
+	// Each migration runs in its own transaction, which takes the migration lock first
+	var applied []int64
+	for n, s := range statements {
+		if s.query != "BEGIN" {
+			continue
+		}
+		assert.True(t, strings.HasPrefix(statements[n+1].query, "SELECT pg_advisory_xact_lock"))
+		assert.Equal(t, int64(migrateLockID), statements[n+1].args[0].Value)
+		for _, s := range statements[n+2:] {
+			if s.query == "COMMIT" {
+				break
+			}
+			assert.NotEqual(t, "BEGIN", s.query)
+			if strings.HasPrefix(s.query, "INSERT INTO schema_version") {
+				applied = append(applied, s.args[0].Value.(int64))
+			}
+		}
+	}
+	var expected []int64
+	for _, m := range migrations {
+		expected = append(expected, int64(m.version))
+	}
+	assert.Equal(t, expected, applied)
+
+	// The postgres triggers are created
+	var all strings.Builder
+	for _, s := range statements {
+		all.WriteString(s.query)
+	}
+	for _, trigger := range []string{
+		"CREATE OR REPLACE FUNCTION update_updated_at_column()",
+		"BEFORE UPDATE OF access_count, version",
+		"CREATE OR REPLACE FUNCTION update_cache_stats()",
+		"CREATE TRIGGER update_cache_stats",
+	} {
+		assert.Contains(t, all.String(), trigger)
+	}
+
+	// Migrations are not run again
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range fakePostgres.recorded()[len(statements):] {
+		assert.False(t, strings.HasPrefix(s.query, "INSERT INTO schema_version"), s.query)
+	}
+}
+
+func TestPostgresStatements(t *testing.T) {
+	db := openFakePostgres(t)
+
+	i := cacheitem.New("testbucket", "testkey", 3, 0, time.Time{})
+	i.Tags = []string{"testtag"}
+	calls := []func() error{
+		func() error { return db.Insert(i) },
+		func() error { return db.Replace(i) },
+		func() error { return db.UpdateAccessCount(i.Bucket, i.Key) },
+		func() error { return db.UpdateSize(i.Bucket, i.Key, 3) },
+		func() error { return db.UpdateKeyHash(i.Bucket, i.Key, "testhash") },
+		func() error {
+			_, err := db.UpdateEncoding(i)
+			return err
+		},
+		func() error {
+			_, err := db.GetItem(i.Bucket, i.Key)
+			return err
+		},
+		func() error {
+			_, err := db.GetTags(i.Bucket, i.Key)
+			return err
+		},
+		func() error {
+			_, err := db.DeleteWithTagContext(context.Background(), "testtag", []int{1, 2})
+			return err
+		},
+		func() error {
+			_, err := db.GetOldestAfterContext(context.Background(), time.Now(), 1)
+			return err
+		},
+		func() error {
+			_, err := db.BucketStatsContext(context.Background(), i.Bucket)
+			return err
+		},
+		func() error {
+			return db.SetBucketConfig(cacheitem.BucketConfig{Bucket: i.Bucket, MaxItems: 10})
+		},
+		func() error {
+			_, err := db.GetBucketConfig(i.Bucket)
+			return err
+		},
+		func() error { return db.DeleteBucketConfig(i.Bucket) },
+		func() error { return db.SetMeta("layout", "hashed") },
+		func() error { return db.RetainBlob("testhash", 3) },
+		func() error { return db.Delete(i.Bucket, i.Key) },
+		func() error {
+			_, err := db.DeleteBucket(i.Bucket)
+			return err
+		},
+		func() error { return db.DeleteAll() },
+	}
+	for _, call := range calls {
+		err := call()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	statements := fakePostgres.recorded()
+	checkPostgresStatements(t, statements)
+
+	// Updates do not change the schema (e.g. to disable the updated_at trigger)
+	for _, s := range statements {
+		assert.NotContains(t, s.query, "TRIGGER")
+	}
+}
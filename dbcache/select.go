@@ -2,6 +2,7 @@ package dbcache
 
 import (
 	"github.com/imclaren/calmcache/cacheitem"
+	"context"
 	"database/sql"
 	"strings"
 	"fmt"
@@ -10,15 +11,31 @@ import (
 
 // GetItem returns a database item
 func (db *DB) GetItem(bucket, key string) (i *cacheitem.Item, err error) {
-	db.RLock()
-	defer db.RUnlock()
+	return db.GetItemContext(context.Background(), bucket, key)
+}
 
+// GetItemContext returns a database item.  The query is cancelled if ctx is done.
+func (db *DB) GetItemContext(ctx context.Context, bucket, key string) (i *cacheitem.Item, err error) {
 	if bucket == "" || key == "" {
 		return nil, fmt.Errorf("empty bucket (%s) or key (%s)", bucket, key)
 	}
 	sqlString := "SELECT * FROM cache WHERE bucket = ? AND key = ?"
 	var newItem cacheitem.Item 
-	err = db.QueryRowx(db.Rebind(sqlString), bucket, key).StructScan(&newItem)
+	err = db.QueryRowxContext(ctx, db.Rebind(sqlString), bucket, key).StructScan(&newItem)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &newItem, nil
+}
+
+// GetItemByKeyHash gets a database item by the hash of its key (see cacheitem.KeyHash).  The item is nil if it does not exist.
+func (db *DB) GetItemByKeyHash(bucket, keyHash string) (i *cacheitem.Item, err error) {
+	sqlString := "SELECT * FROM cache WHERE bucket = ? AND key_hash = ?"
+	var newItem cacheitem.Item
+	err = db.QueryRowx(db.Rebind(sqlString), bucket, keyHash).StructScan(&newItem)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -30,9 +47,6 @@ func (db *DB) GetItem(bucket, key string) (i *cacheitem.Item, err error) {
 
 // GetAllInBucket returns all of the database items in a bucket
 func (db *DB) GetAllInBucket(bucket string) ([]cacheitem.Item, error) {
-	db.RLock()
-	defer db.RUnlock()
-
 	sqlString := "SELECT * FROM cache WHERE bucket = ? ORDER BY key ASC"
 	var items []cacheitem.Item
 	err := db.Select(&items, db.Rebind(sqlString), bucket)
@@ -41,9 +55,6 @@ func (db *DB) GetAllInBucket(bucket string) ([]cacheitem.Item, error) {
 
 // GetOldestInBucket returns the oldest (i.e. last accessed) database item
 func (db *DB) GetOldestInBucket(bucket string) (i *cacheitem.Item, err error) {
-	db.RLock()
-	defer db.RUnlock()
-
 	sqlString := "SELECT * FROM cache WHERE bucket = ? ORDER BY updated_at ASC LIMIT 1"
 	var newItem cacheitem.Item 
 	err = db.QueryRowx(db.Rebind(sqlString), bucket).StructScan(&newItem)
@@ -56,41 +67,136 @@ func (db *DB) GetOldestInBucket(bucket string) (i *cacheitem.Item, err error) {
 	return &newItem, nil
 }
 
+// GetOldestInBucketSkipping returns the oldest (i.e. last accessed) database item after skipping the skip oldest items.
+// Use this to find the next oldest item when the oldest items cannot be deleted.
+func (db *DB) GetOldestInBucketSkipping(bucket string, skip int) (i *cacheitem.Item, err error) {
+	return db.GetOldestInBucketSkippingContext(context.Background(), bucket, skip)
+}
+
+// GetOldestInBucketSkippingContext is GetOldestInBucketSkipping with a context.  The query is cancelled if ctx is done.
+func (db *DB) GetOldestInBucketSkippingContext(ctx context.Context, bucket string, skip int) (i *cacheitem.Item, err error) {
+	sqlString := "SELECT * FROM cache WHERE bucket = ? ORDER BY updated_at ASC, id ASC LIMIT 1 OFFSET ?"
+	var newItem cacheitem.Item
+	err = db.QueryRowxContext(ctx, db.Rebind(sqlString), bucket, skip).StructScan(&newItem)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &newItem, nil
+}
+
+// GetFirstInBucketSkippingContext returns the first database item in the order given by orderBy, after skipping the skip first items.
+// OrderBy is an SQL ORDER BY expression on the cache columns (e.g. "access_count ASC, updated_at ASC") with args for its placeholders.
+// Items are then ordered by id.  Note that orderBy must not contain user input.  The query is cancelled if ctx is done.
+func (db *DB) GetFirstInBucketSkippingContext(ctx context.Context, bucket string, orderBy string, args []interface{}, skip int) (i *cacheitem.Item, err error) {
+	sqlString := fmt.Sprintf("SELECT * FROM cache WHERE bucket = ? ORDER BY %s, id ASC LIMIT 1 OFFSET ?", orderBy)
+	queryArgs := append([]interface{}{bucket}, args...)
+	queryArgs = append(queryArgs, skip)
+	var newItem cacheitem.Item
+	err = db.QueryRowxContext(ctx, db.Rebind(sqlString), queryArgs...).StructScan(&newItem)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &newItem, nil
+}
+
+// GetOldestAfterContext returns the oldest (i.e. last accessed) database item in any bucket that comes after the item with the
+// last accessed time updatedAt and the id id, in (updated_at, id) order.  Use the zero time and id to get the oldest item.
+// Use this to page through the oldest items when the oldest items cannot be deleted.  The query is cancelled if ctx is done.
+func (db *DB) GetOldestAfterContext(ctx context.Context, updatedAt time.Time, id int) (i *cacheitem.Item, err error) {
+	sqlString := "SELECT * FROM cache WHERE (updated_at, id) > (?, ?) ORDER BY updated_at ASC, id ASC LIMIT 1"
+	var newItem cacheitem.Item
+	err = db.QueryRowxContext(ctx, db.Rebind(sqlString), db.timestamp(updatedAt), id).StructScan(&newItem)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &newItem, nil
+}
+
+// timestamp returns a time as a query argument that compares equal to the same time set by the database.
+// Sqlite timestamps are text with millisecond precision (see sqliteCacheUpdatedAtTrigger).
+func (db *DB) timestamp(t time.Time) interface{} {
+	if db.Type == "sqlite" {
+		return t.UTC().Format("2006-01-02 15:04:05.000")
+	}
+	return t.UTC()
+}
+
 // AllInBucketOlderThan returns all database items that are older than (i.e. last accessed before) the provided time.Duration
 func (db *DB) AllInBucketOlderThan(bucket string, d time.Duration) (items []cacheitem.Item, err error) {
-	db.RLock()
-	defer db.RUnlock()
+	return db.AllInBucketOlderThanContext(context.Background(), bucket, d)
+}
 
+// AllInBucketOlderThanContext is AllInBucketOlderThan with a context.  The query is cancelled if ctx is done.
+func (db *DB) AllInBucketOlderThanContext(ctx context.Context, bucket string, d time.Duration) (items []cacheitem.Item, err error) {
 	targetTS := time.Now().Add(-d)
 	sqlString := "SELECT * FROM cache WHERE bucket = ? AND updated_at < ? ORDER BY updated_at ASC"
 
-	var newItems []cacheitem.Item
-	err = db.Select(&items, db.Rebind(sqlString), bucket, targetTS)
+	err = db.SelectContext(ctx, &items, db.Rebind(sqlString), bucket, targetTS.UTC())
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return []cacheitem.Item{}, nil
 		}
 		return nil, err
 	}
-	return newItems, nil
+	return items, nil
+}
+
+// AllExpired returns all database items that have an expiry time that has passed
+func (db *DB) AllExpired() (items []cacheitem.Item, err error) {
+	sqlString := "SELECT * FROM cache WHERE expires_at > ? AND expires_at <= ? ORDER BY expires_at ASC"
+	err = db.Select(&items, db.Rebind(sqlString), time.Time{}, time.Now().UTC())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []cacheitem.Item{}, nil
+		}
+		return nil, err
+	}
+	return items, nil
+}
+
+// Buckets returns the names of all of the buckets in the cache
+func (db *DB) Buckets() (buckets []string, err error) {
+	sqlString := "SELECT DISTINCT bucket FROM cache ORDER BY bucket ASC"
+	err = db.Select(&buckets, db.Rebind(sqlString))
+	return buckets, err
 }
 
 // All returns all database items in the cache
 func (db *DB) All() ([]cacheitem.Item, error) {
-	db.RLock()
-	defer db.RUnlock()
-
 	sqlString := "SELECT * FROM cache"
 	var items []cacheitem.Item
 	err := db.Select(&items, db.Rebind(sqlString))
 	return items, err
 }
 
+// AllAfterID returns up to limit database items with an id greater than id, in id order.
+// Use this to page through all of the items in the cache without holding them in memory.
+func (db *DB) AllAfterID(id int, limit int) ([]cacheitem.Item, error) {
+	sqlString := "SELECT * FROM cache WHERE id > ? ORDER BY id ASC LIMIT ?"
+	var items []cacheitem.Item
+	err := db.Select(&items, db.Rebind(sqlString), id, limit)
+	return items, err
+}
+
+// AllNotEncryptedWithKeyAfterID returns up to limit items with an id greater than id that are not encrypted with the key keyID (ordered by id)
+func (db *DB) AllNotEncryptedWithKeyAfterID(keyID string, id int, limit int) ([]cacheitem.Item, error) {
+	sqlString := "SELECT * FROM cache WHERE key_id != ? AND id > ? ORDER BY id ASC LIMIT ?"
+	var items []cacheitem.Item
+	err := db.Select(&items, db.Rebind(sqlString), keyID, id, limit)
+	return items, err
+}
+
 // AllInBucketCount returns the number of items in a bucket
 func (db *DB) AllInBucketCount(bucket string) (count int, err error) {
-	db.RLock()
-	defer db.RUnlock()
-
 	sqlString := "SELECT COUNT(*) FROM cache WHERE bucket = ?"
 	var c int
 	err = db.Get(&c, db.Rebind(sqlString), bucket)
@@ -109,10 +215,7 @@ func (db *DB) AllInBucketCount(bucket string) (count int, err error) {
 
 // AllCount returns the number of items in the cache
 func (db *DB) AllCount() (count int, err error) {
-	db.RLock()
-	defer db.RUnlock()
-
-	sqlString := "SELECT COUNT(*) FROM cache"
+	sqlString := "SELECT COALESCE(SUM(item_count), 0) FROM cache_stats"
 	var c int
 	err = db.Get(&c, db.Rebind(sqlString))
 	if err != nil {
@@ -130,12 +233,14 @@ func (db *DB) AllCount() (count int, err error) {
 
 // BucketSize returns the total size (in bytes) of the items in a bucket
 func (db *DB) BucketSize(bucket string) (size int64, err error) {
-	db.RLock()
-	defer db.RUnlock()
+	return db.BucketSizeContext(context.Background(), bucket)
+}
 
+// BucketSizeContext is BucketSize with a context.  The query is cancelled if ctx is done.
+func (db *DB) BucketSizeContext(ctx context.Context, bucket string) (size int64, err error) {
 	sqlString := "SELECT SUM(size) FROM cache WHERE bucket = ?"
 	var s int64
-	err = db.Get(&s, db.Rebind(sqlString), bucket)
+	err = db.GetContext(ctx, &s, db.Rebind(sqlString), bucket)
 	if err != nil {
 		switch {
 		case strings.Contains(err.Error(), "converting NULL to int64 is unsupported"):
@@ -149,12 +254,9 @@ func (db *DB) BucketSize(bucket string) (size int64, err error) {
 	return s, nil
 }
 
-// Size returns the total size (in bytes) of the items in the cache 
+// Size returns the total size (in bytes) of the items in the cache.  The size is read from the cache_stats table, so the items are not summed.
 func (db *DB) Size() (size int64, err error) {
-	db.RLock()
-	defer db.RUnlock()
-
-	sqlString := "SELECT SUM(size) FROM cache"
+	sqlString := "SELECT SUM(size) FROM cache_stats"
 	var s int64
 	err = db.Get(&s, db.Rebind(sqlString))
 	if err != nil {
@@ -169,3 +271,22 @@ func (db *DB) Size() (size int64, err error) {
 	}
 	return s, nil
 }
+
+// BucketStoredSize returns the total stored size (in bytes) of the items in a bucket.  The stored size is the size of the encoded (e.g. compressed) values.
+func (db *DB) BucketStoredSize(bucket string) (size int64, err error) {
+	return db.BucketStoredSizeContext(context.Background(), bucket)
+}
+
+// BucketStoredSizeContext is BucketStoredSize with a context.  The query is cancelled if ctx is done.
+func (db *DB) BucketStoredSizeContext(ctx context.Context, bucket string) (size int64, err error) {
+	sqlString := "SELECT COALESCE(SUM(stored_size), 0) FROM cache WHERE bucket = ?"
+	err = db.GetContext(ctx, &size, db.Rebind(sqlString), bucket)
+	return size, err
+}
+
+// StoredSize returns the total stored size (in bytes) of the items in the cache.  The stored size is the size of the encoded (e.g. compressed) values.
+func (db *DB) StoredSize() (size int64, err error) {
+	sqlString := "SELECT COALESCE(SUM(stored_size), 0) FROM cache_stats"
+	err = db.Get(&size, db.Rebind(sqlString))
+	return size, err
+}
@@ -0,0 +1,58 @@
+package dbcache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/imclaren/calmcache/cacheitem"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestGetOldestAfter(t *testing.T) {
+	tempDirName, err := os.MkdirTemp("", "calmcachedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDirName)
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := Init(filepath.Join(tempDirName, "cache.db"), ctx, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for n := 0; n < 3; n++ {
+		err = db.Insert(cacheitem.New("testbucket", fmt.Sprintf("testkey%d", n), 3, 0, time.Time{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Give the last two items the same last accessed time, so that they are paged in id order
+	_, err = db.Exec("UPDATE cache SET updated_at = '2000-01-01 00:00:00.123' WHERE key != 'testkey0'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE cache SET updated_at = '1999-01-01 00:00:00.000' WHERE key = 'testkey0'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	var after cacheitem.Item
+	for {
+		i, err := db.GetOldestAfterContext(context.Background(), after.UpdatedAt, after.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == nil {
+			break
+		}
+		keys = append(keys, i.Key)
+		after = *i
+	}
+	assert.Equal(t, []string{"testkey0", "testkey1", "testkey2"}, keys)
+}
@@ -0,0 +1,61 @@
+package dbcache
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// Stats returns the number, total size and total stored size of the items in the cache.
+// The totals are kept in the cache_stats table by triggers on the cache table, so the items are not summed.
+func (db *DB) Stats() (s cacheitem.Stats, err error) {
+	return db.StatsContext(context.Background())
+}
+
+// StatsContext is Stats with a context.  The query is cancelled if ctx is done.
+func (db *DB) StatsContext(ctx context.Context) (s cacheitem.Stats, err error) {
+	sqlString := `
+		SELECT COALESCE(SUM(item_count), 0) AS item_count, COALESCE(SUM(size), 0) AS size, COALESCE(SUM(stored_size), 0) AS stored_size
+		FROM cache_stats
+	`
+	err = db.GetContext(ctx, &s, sqlString)
+	return s, err
+}
+
+// RecountStats recounts the totals in the cache_stats table from the cache table
+func (db *DB) RecountStats() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = recountStats(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recountStats(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM cache_stats")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO cache_stats (bucket, item_count, size, stored_size)
+		SELECT bucket, COUNT(*), COALESCE(SUM(size), 0), COALESCE(SUM(stored_size), 0) FROM cache GROUP BY bucket
+	`)
+	return err
+}
+
+// BucketStatsContext returns the number, total size and total stored size of the items in a bucket.
+// The query is cancelled if ctx is done.
+func (db *DB) BucketStatsContext(ctx context.Context, bucket string) (s cacheitem.Stats, err error) {
+	sqlString := "SELECT item_count, size, stored_size FROM cache_stats WHERE bucket = ?"
+	err = db.GetContext(ctx, &s, db.Rebind(sqlString), bucket)
+	if err == sql.ErrNoRows {
+		return cacheitem.Stats{}, nil
+	}
+	return s, err
+}
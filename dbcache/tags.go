@@ -0,0 +1,98 @@
+package dbcache
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// GetTags returns the tags of an item (ordered by tag)
+func (db *DB) GetTags(bucket, key string) (tags []string, err error) {
+	sqlString := "SELECT tag FROM cache_tags WHERE bucket = ? AND key = ? ORDER BY tag ASC"
+	err = db.Select(&tags, db.Rebind(sqlString), bucket, key)
+	return tags, err
+}
+
+// AllWithTagAfterIDContext returns up to limit items with the tag and an id greater than id (ordered by id).
+// Use the id of the last item returned to get the next page, so that the items do not need to be loaded into memory at once.
+// The query is cancelled if ctx is done.
+func (db *DB) AllWithTagAfterIDContext(ctx context.Context, tag string, id int, limit int) (items []cacheitem.Item, err error) {
+	sqlString := `
+		SELECT cache.* FROM cache
+		JOIN cache_tags ON cache_tags.bucket = cache.bucket AND cache_tags.key = cache.key
+		WHERE cache_tags.tag = ? AND cache.id > ?
+		ORDER BY cache.id ASC LIMIT ?
+	`
+	err = db.SelectContext(ctx, &items, db.Rebind(sqlString), tag, id, limit)
+	return items, err
+}
+
+// DeleteWithTagContext deletes the items with the ids that still have the tag, and their tags, in one transaction,
+// and returns the deleted items (ordered by id).  Use this with a page of items returned by AllWithTagAfterIDContext.
+// The items are deleted with one statement for each table.  The query is cancelled if ctx is done.
+func (db *DB) DeleteWithTagContext(ctx context.Context, tag string, ids []int) (items []cacheitem.Item, err error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := []interface{}{tag}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	sqlString := `
+		SELECT cache.* FROM cache
+		JOIN cache_tags ON cache_tags.bucket = cache.bucket AND cache_tags.key = cache.key
+		WHERE cache_tags.tag = ? AND cache.id IN (` + placeholders + `)
+		ORDER BY cache.id ASC
+	`
+	err = tx.SelectContext(ctx, &items, db.Rebind(sqlString), args...)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	placeholders = strings.TrimSuffix(strings.Repeat("?,", len(items)), ",")
+	args = nil
+	for _, i := range items {
+		args = append(args, i.Id)
+	}
+	sqlString = `
+		DELETE FROM cache_tags WHERE EXISTS (
+			SELECT 1 FROM cache WHERE cache.bucket = cache_tags.bucket AND cache.key = cache_tags.key AND cache.id IN (` + placeholders + `)
+		)
+	`
+	_, err = tx.ExecContext(ctx, db.Rebind(sqlString), args...)
+	if err != nil {
+		return nil, err
+	}
+	sqlString = "DELETE FROM cache WHERE id IN (" + placeholders + ")"
+	_, err = tx.ExecContext(ctx, db.Rebind(sqlString), args...)
+	if err != nil {
+		return nil, err
+	}
+	return items, tx.Commit()
+}
+
+// insertTags adds tags to an item.  Duplicate tags are ignored.
+func insertTags(tx *sql.Tx, db *DB, bucket, key string, tags []string) error {
+	sqlString := db.Rebind("INSERT INTO cache_tags (tag, bucket, key) VALUES (?,?,?) ON CONFLICT (tag, bucket, key) DO NOTHING")
+	for _, tag := range tags {
+		_, err := tx.Exec(sqlString, tag, bucket, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTags removes all of the tags of an item
+func deleteTags(tx *sql.Tx, db *DB, bucket, key string) error {
+	sqlString := "DELETE FROM cache_tags WHERE bucket = ? AND key = ?"
+	_, err := tx.Exec(db.Rebind(sqlString), bucket, key)
+	return err
+}
@@ -1,25 +1,95 @@
 package dbcache
 
+import (
+	"context"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
 // UpdateAccessCount updates the access count of an item
 func (db *DB) UpdateAccessCount(bucket, key string) (err error) {
-	db.Lock()
-	defer db.Unlock()
+	return db.UpdateAccessCountContext(context.Background(), bucket, key)
+}
 
+// UpdateAccessCountContext updates the access count of an item.  The update is cancelled if ctx is done.
+// The count is incremented in a single statement, so concurrent updates from other connections are not lost.
+func (db *DB) UpdateAccessCountContext(ctx context.Context, bucket, key string) (err error) {
+	sqlString := "UPDATE cache SET access_count = access_count + 1 WHERE bucket = ? AND key = ?"
+	_, err = db.ExecContext(ctx, db.Rebind(sqlString), bucket, key)
+	return err
+}
+
+// Replace replaces the size, expiry time, checksum, blob, codec, stored size, key ID, metadata and tags of an existing item, and increments the item version
+func (db *DB) Replace(i cacheitem.Item) error {
 	tx, err := db.Begin()
-    if err != nil {
-        return err
-    }
-    defer tx.Rollback()
-    var accessCount int64
-    sqlString := "SELECT access_count FROM cache WHERE bucket = ? AND key = ?"
-	err = tx.QueryRow(db.Rebind(sqlString), bucket, key).Scan(&accessCount)
 	if err != nil {
 		return err
 	}
-	sqlString = "UPDATE cache SET access_count = ? WHERE bucket = ? AND key = ?"
-	_, err = tx.Exec(db.Rebind(sqlString), accessCount+1, bucket, key)
+	defer tx.Rollback()
+	sqlString := "UPDATE cache SET size = ?, expires_at = ?, checksum = ?, blob = ?, codec = ?, stored_size = ?, key_id = ?, content_type = ?, content_encoding = ?, etag = ?, metadata = ?, version = version + 1 WHERE bucket = ? AND key = ?"
+	_, err = tx.Exec(db.Rebind(sqlString),
+		i.Size,
+		i.ExpiresAt,
+		i.Checksum,
+		i.Blob,
+		i.Codec,
+		i.StoredSize,
+		i.KeyID,
+		i.ContentType,
+		i.ContentEncoding,
+		i.ETag,
+		i.Metadata,
+		i.Bucket,
+		i.Key,
+	)
+	if err != nil {
+		return err
+	}
+	err = deleteTags(tx, db, i.Bucket, i.Key)
+	if err != nil {
+		return err
+	}
+	err = insertTags(tx, db, i.Bucket, i.Key, i.Tags)
 	if err != nil {
 		return err
 	}
-    return tx.Commit()
+	return tx.Commit()
+}
+
+// UpdateSize updates the size and stored size of an item that is not encoded.  The last accessed time of the item is not changed.
+func (db *DB) UpdateSize(bucket, key string, size int64) error {
+	sqlString := "UPDATE cache SET size = ?, stored_size = ? WHERE bucket = ? AND key = ?"
+	_, err := db.Exec(db.Rebind(sqlString), size, size, bucket, key)
+	return err
+}
+
+// UpdateEncoding replaces the checksum, blob, codec, stored size and key ID of an existing item with the same version.
+// The item version and last accessed time are not changed, because the item value does not change.  OK returns false if the item version has changed.
+func (db *DB) UpdateEncoding(i cacheitem.Item) (OK bool, err error) {
+	sqlString := "UPDATE cache SET checksum = ?, blob = ?, codec = ?, stored_size = ?, key_id = ? WHERE bucket = ? AND key = ? AND version = ?"
+	res, err := db.Exec(db.Rebind(sqlString),
+		i.Checksum,
+		i.Blob,
+		i.Codec,
+		i.StoredSize,
+		i.KeyID,
+		i.Bucket,
+		i.Key,
+		i.Version,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UpdateKeyHash sets the key hash of an item (see cacheitem.KeyHash).  The last accessed time of the item is not changed.
+func (db *DB) UpdateKeyHash(bucket, key, keyHash string) error {
+	sqlString := "UPDATE cache SET key_hash = ? WHERE bucket = ? AND key = ?"
+	_, err := db.Exec(db.Rebind(sqlString), keyHash, bucket, key)
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,113 @@
+package calmcache
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/imclaren/calmcache/cacheitem"
+	"github.com/imclaren/calmcache/filecache"
+)
+
+const (
+	// DedupBucket is the blob store bucket that holds deduplicated values (see Options.Dedup).
+	// It cannot be used as a cache bucket.
+	DedupBucket = ".dedup"
+)
+
+// validBucket returns an error if a bucket name cannot be used.  Bucket names cannot contain path separators,
+// and bucket names that start with "." are reserved for internal buckets (e.g. DedupBucket).
+func validBucket(bucket string) error {
+	err := filecache.ValidBucket(bucket)
+	if err != nil {
+		return fmt.Errorf("cache error: invalid bucket name: %q", bucket)
+	}
+	if strings.HasPrefix(bucket, ".") {
+		return fmt.Errorf("cache error: reserved bucket name: %q", bucket)
+	}
+	return nil
+}
+
+// blobLocation returns the blob store bucket and key that hold the value of an item
+func blobLocation(i cacheitem.Item) (bucket, key string) {
+	if i.Blob != "" {
+		return DedupBucket, i.Blob
+	}
+	return i.Bucket, i.Key
+}
+
+// createDedupBlob stores a value once by content hash, and adds a reference to the deduplicated blob.
+// The value is only stored if the blob does not already exist.  Note that the item must be locked by the caller.
+func (c *Cache) createDedupBlob(hash string, r io.Reader, size int64) error {
+	unlock := c.lockBlob(hash)
+	defer unlock()
+
+	b, err := c.DB.GetBlob(hash)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		_, err = c.Store.Create(DedupBucket, hash, r, size)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.DB.RetainBlob(hash, size)
+	if err != nil {
+		if b == nil {
+			c.Store.Remove(DedupBucket, hash)
+		}
+		return err
+	}
+	return nil
+}
+
+// releaseBlob removes a reference to a deduplicated blob, and removes the blob when it has no remaining references
+func (c *Cache) releaseBlob(hash string) error {
+	unlock := c.lockBlob(hash)
+	defer unlock()
+
+	refcount, err := c.DB.ReleaseBlob(hash)
+	if err != nil {
+		return err
+	}
+	if refcount > 0 {
+		return nil
+	}
+	return c.Store.Remove(DedupBucket, hash)
+}
+
+// removeUnreferencedBlob removes a deduplicated blob that has no references, unless it has been referenced again since it was released
+func (c *Cache) removeUnreferencedBlob(hash string) error {
+	unlock := c.lockBlob(hash)
+	defer unlock()
+
+	b, err := c.DB.GetBlob(hash)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		return nil
+	}
+	return c.Store.Remove(DedupBucket, hash)
+}
+
+// removeValue removes the value of an item that has been deleted from the database
+func (c *Cache) removeValue(i cacheitem.Item) error {
+	if i.Blob != "" {
+		return c.releaseBlob(i.Blob)
+	}
+	return c.Store.Remove(i.Bucket, i.Key)
+}
+
+// removeReplacedValue removes the old value of an item that has been replaced in the database.
+// A value that is not deduplicated is overwritten in place, so it is only removed if the new value is deduplicated.
+func (c *Cache) removeReplacedValue(old, new cacheitem.Item) error {
+	if old.Blob != "" {
+		return c.releaseBlob(old.Blob)
+	}
+	if new.Blob != "" {
+		return c.Store.Remove(old.Bucket, old.Key)
+	}
+	return nil
+}
@@ -1,53 +1,133 @@
 package calmcache
 
+import (
+	"context"
+	"os"
+)
+
 // DeleteCache deletes the cache
+// If the database is not stored in the cache directory (i.e. a DSN was provided), all of the database items are deleted.
+// If the cache does not use a file cache, the blobs in each bucket in the database are deleted from the blob store.
+// Note that DeleteCache does not wait for open Readers to be closed.
 func (c *Cache) DeleteCache() (err error) {
 	c.Lock()
 	defer c.Unlock()
 
-	c.DB.Lock()
-	defer c.DB.Unlock()
-
-	return c.FC.DeleteCache()
+	if c.FC == nil {
+		buckets, err := c.DB.Buckets()
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, DedupBucket)
+		for _, bucket := range buckets {
+			err = c.Store.RemoveBucket(bucket)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if c.FC == nil {
+		err = os.RemoveAll(c.Path)
+	} else {
+		err = c.FC.DeleteCache()
+	}
+	if err != nil {
+		return err
+	}
+	if c.opts.DSN != "" {
+		return c.DB.DeleteAll()
+	}
+	return nil
 }
 
 // DeleteBucket deletes the bucket
+// Note that DeleteBucket does not wait for open Readers to be closed.
+// Deduplicated values that are no longer used by any item are also deleted.
 func (c *Cache) DeleteBucket(bucket string) error {
-	c.Lock()
-	defer c.Unlock()
+	err := validBucket(bucket)
+	if err != nil {
+		return err
+	}
 
-	err := c.DB.DeleteBucket(bucket)
+	unlock := c.lockBucket(bucket)
+	defer unlock()
+
+	err = c.checkOpen()
+	if err != nil {
+		return err
+	}
+	unreferenced, err := c.DB.DeleteBucket(bucket)
+	if err != nil {
+		return err
+	}
+	err = c.Store.RemoveBucket(bucket)
 	if err != nil {
 		return err
 	}
-	return c.FC.DeleteBucket(bucket)
+	for _, hash := range unreferenced {
+		err = c.removeUnreferencedBlob(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Delete deletes an item from a bucket
 func (c *Cache) Delete(bucket, key string) (OK bool, err error) {
-	c.Lock()
-	defer c.Unlock()
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
 
-	return c.delete(bucket, key)
+	return c.delete(context.Background(), bucket, key)
 }
 
-func (c *Cache) delete(bucket, key string) (OK bool, err error) {
-	exists, err := c.exists(bucket, key)
-	err = c.DB.Delete(bucket, key)
+// Remove deletes an item from a bucket.  If the item does not exist (or has expired), the error wraps ErrNotFound.
+// Errors are returned as an ItemError.
+func (c *Cache) Remove(bucket, key string) error {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	i, expired, err := c.getItem(context.Background(), bucket, key)
+	if err != nil {
+		return itemError("remove", bucket, key, err)
+	}
+	if i == nil && !expired {
+		return itemError("remove", bucket, key, ErrNotFound)
+	}
+	_, err = c.delete(context.Background(), bucket, key)
+	if err != nil {
+		return itemError("remove", bucket, key, err)
+	}
+	if expired {
+		return itemError("remove", bucket, key, ErrNotFound)
+	}
+	return nil
+}
+
+// delete deletes an item from a bucket.  A deduplicated value is only deleted when it is no longer used by any item.
+// The delete stops if ctx is done before the item has been deleted from the database.  The value is then removed even if ctx is done.
+func (c *Cache) delete(ctx context.Context, bucket, key string) (OK bool, err error) {
+	if key == "" {
+		return false, ErrEmptyKey
+	}
+	err = c.checkOpen()
 	if err != nil {
 		return false, err
 	}
-	if !exists {
-		return true, nil
+	i, err := c.DB.GetItemContext(ctx, bucket, key)
+	if err != nil {
+		return false, err
 	}
-	err = c.DB.Delete(bucket, key)
+	err = c.DB.DeleteContext(ctx, bucket, key)
 	if err != nil {
 		return false, err
 	}
-	err = c.FC.Delete(bucket, key)
+	if i == nil {
+		return true, nil
+	}
+	err = c.removeValue(*i)
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
-
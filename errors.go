@@ -0,0 +1,69 @@
+package calmcache
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when an item does not exist (or has expired)
+	ErrNotFound = errors.New("cache error: item not found")
+	// ErrExists is returned when an item is inserted, but the bucket already contains a value for the key
+	ErrExists = errors.New("cache error: item already exists")
+	// ErrEmptyKey is returned when an empty key is provided
+	ErrEmptyKey = errors.New("cache error: empty key provided")
+	// ErrClosed is returned when the cache is used after it has been closed
+	ErrClosed = errors.New("cache error: cache is closed")
+	// ErrSizeMismatch is returned when a put reads more or fewer bytes than the size provided
+	ErrSizeMismatch = errors.New("cache error: size mismatch")
+	// ErrInvalidRange is returned when a range read starts before the start or after the end of a value
+	ErrInvalidRange = errors.New("cache error: invalid range")
+	// ErrCacheFull is returned when a put would exceed Options.MaxSize or Options.MaxItems, and items are not evicted to make room
+	ErrCacheFull = errors.New("cache error: cache is full")
+	// ErrQuotaExceeded is returned when a put would exceed the quotas of a bucket (see SetBucketConfig), and items are not evicted to make room
+	ErrQuotaExceeded = errors.New("cache error: bucket quota exceeded")
+)
+
+// ItemError is returned by the error returning API (e.g. Insert, Lookup and Remove).  It records the operation, bucket and key.
+// Use errors.Is to check for the wrapped error (e.g. errors.Is(err, calmcache.ErrNotFound)).
+type ItemError struct {
+	Op     string
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("cache %s error: %s %s: %v", e.Op, e.Bucket, e.Key, e.Err)
+}
+
+// Unwrap returns the wrapped error
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+func itemError(op, bucket, key string, err error) error {
+	return &ItemError{Op: op, Bucket: bucket, Key: key, Err: err}
+}
+
+// ErrCorrupt is returned (wrapped in a CorruptError) when the checksum of an item does not match the checksum of the stored value.
+// Use errors.Is(err, calmcache.ErrCorrupt) to check for corrupt items.
+var ErrCorrupt = errors.New("cache error: corrupt item")
+
+// CorruptError is returned when the checksum of an item does not match the checksum of the stored value.
+// Corrupt items are deleted from the cache.  If a corrupt item cannot be deleted, the CorruptError is joined with the delete error.
+type CorruptError struct {
+	Bucket   string
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("cache error: corrupt item: %s %s checksum %s does not match %s", e.Bucket, e.Key, e.Actual, e.Expected)
+}
+
+// Unwrap returns ErrCorrupt
+func (e *CorruptError) Unwrap() error {
+	return ErrCorrupt
+}
@@ -0,0 +1,63 @@
+package calmcache
+
+import (
+	"time"
+)
+
+// EvictionPolicy chooses the items that are deleted first when a bucket is pruned to a target size (see PruneToSize).
+// Policies are selected per bucket using Options.EvictionPolicy and Options.BucketEvictionPolicies.
+type EvictionPolicy interface {
+	// Order returns an SQL ORDER BY expression on the cache table columns (e.g. size, access_count, created_at and updated_at)
+	// that orders the items in a bucket from the first to the last to be evicted, with the arguments for its placeholders.
+	// Items with the same order are evicted in id order.  Note that the expression is not escaped, so it must not contain user input.
+	Order(now time.Time) (orderBy string, args []interface{})
+}
+
+// LRU evicts the least recently used items first.  This is the default eviction policy.
+type LRU struct{}
+
+// Order implements EvictionPolicy
+func (LRU) Order(now time.Time) (orderBy string, args []interface{}) {
+	return "updated_at ASC", nil
+}
+
+// LFU evicts the least frequently used items first (by access count).  Items with the same access count are evicted in LRU order.
+type LFU struct{}
+
+// Order implements EvictionPolicy
+func (LFU) Order(now time.Time) (orderBy string, args []interface{}) {
+	return "access_count ASC, updated_at ASC", nil
+}
+
+// SizeAware evicts the largest cold items first, so that fewer items are evicted to reach the target size.
+// Items are cold if they have not been accessed for ColdAfter.  Items that are not cold are then evicted in LRU order.
+type SizeAware struct {
+	ColdAfter time.Duration
+}
+
+// Order implements EvictionPolicy
+func (p SizeAware) Order(now time.Time) (orderBy string, args []interface{}) {
+	return "CASE WHEN updated_at < ? THEN size ELSE -1 END DESC, updated_at ASC", []interface{}{now.Add(-p.ColdAfter).UTC()}
+}
+
+// GreedyDualSize evicts the items with the lowest value per byte first, in the style of the GreedyDual-Size-Frequency algorithm.
+// The value of an item is its access count plus one (i.e. the cost of fetching it again each time it is used), divided by its size,
+// so small items that are used often are kept, and large items that are rarely used are evicted.
+// Items with the same value are evicted in LRU order, which stands in for the aging of the original algorithm.
+type GreedyDualSize struct{}
+
+// Order implements EvictionPolicy
+func (GreedyDualSize) Order(now time.Time) (orderBy string, args []interface{}) {
+	return "(access_count + 1.0) / (size + 1.0) ASC, updated_at ASC", nil
+}
+
+// evictionPolicy returns the eviction policy of a bucket
+func (c *Cache) evictionPolicy(bucket string) EvictionPolicy {
+	if p, ok := c.opts.BucketEvictionPolicies[bucket]; ok && p != nil {
+		return p
+	}
+	if c.opts.EvictionPolicy != nil {
+		return c.opts.EvictionPolicy
+	}
+	return LRU{}
+}
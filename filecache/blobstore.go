@@ -0,0 +1,132 @@
+package filecache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/imclaren/calmcache/blobstore"
+)
+
+// FileCache implements blobstore.BlobStore
+var _ blobstore.BlobStore = (*FileCache)(nil)
+
+// Create streams the contents of r to the file for the bucket and key.
+// The file cache is not locked while the file is written, so files with different keys can be created concurrently.
+func (fc *FileCache) Create(bucket, key string, r io.Reader, size int64) (n int64, err error) {
+	for attempt := 0; ; attempt++ {
+		var fullPath string
+		fullPath, err = fc.FilePath(bucket, key, true)
+		if err != nil {
+			return 0, err
+		}
+		n, err = writeFile(fullPath, r, size)
+		// Retry if the subdirs were removed by a concurrent delete before the file was created
+		if err != nil && n == 0 && attempt < maxDirRetries && dirRemoved(fullPath) {
+			continue
+		}
+		break
+	}
+
+	fc.RLock()
+	defer fc.RUnlock()
+
+	if err != nil || fc.previous == nil {
+		return n, err
+	}
+	// Remove the file from the previous layout so that it is not moved over the new file
+	err = fc.delete(fc.previous, bucket, key)
+	if err != nil && !os.IsNotExist(err) {
+		return n, err
+	}
+	return n, nil
+}
+
+// Open opens the file for the bucket and key for reading
+func (fc *FileCache) Open(bucket, key string) (blobstore.Blob, error) {
+	fullPath, err := fc.FilePath(bucket, key, false)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(fullPath, os.O_RDONLY, FileMode)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Remove removes the file for the bucket and key, and any empty subdirs
+func (fc *FileCache) Remove(bucket, key string) error {
+	err := fc.Delete(bucket, key)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Stat returns information about the file for the bucket and key
+func (fc *FileCache) Stat(bucket, key string) (blobstore.Info, error) {
+	fullPath, err := fc.FilePath(bucket, key, false)
+	if err != nil {
+		return blobstore.Info{}, err
+	}
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return blobstore.Info{}, err
+	}
+	return blobstore.Info{
+		Bucket:  bucket,
+		Key:     key,
+		Name:    fullPath,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// List walks the file cache and calls fn for each file.  Temporary files are included (see IsTempFile).
+// The bucket and key are derived from the file path, and are empty if the file is not within a bucket.
+// Files stored using a layout that does not record the key (e.g. the hashed layout) have a key hash instead of a key.
+// Note that the key is derived using the current layout, so List should not be used during a layout migration.
+// Note that List does not lock the file cache, so that fn can call other FileCache methods.
+func (fc *FileCache) List(fn func(blobstore.Info) error) error {
+	return filepath.Walk(fc.path, func(fullPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(fc.path, fullPath)
+		if err != nil {
+			return err
+		}
+		info := blobstore.Info{
+			Name:    fullPath,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Temp:    IsTempFile(fi.Name()),
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) > 1 && !info.Temp {
+			info.Bucket = parts[0]
+			fc.RLock()
+			info.Key, info.KeyHash = fc.layout.Key(info.Bucket, fi.Name())
+			fc.RUnlock()
+		}
+		return fn(info)
+	})
+}
+
+// RemoveBucket removes all of the files in a bucket
+func (fc *FileCache) RemoveBucket(bucket string) error {
+	return fc.DeleteBucket(bucket)
+}
+
+// RemoveFile removes a file at a path within the file cache
+func (fc *FileCache) RemoveFile(fullPath string) error {
+	fc.RLock()
+	defer fc.RUnlock()
+
+	return os.Remove(fullPath)
+}
@@ -19,41 +19,85 @@ func (fc *FileCache) DeleteBucket(bucket string) error {
 	fc.Lock()
 	defer fc.Unlock()
 
+	err := ValidBucket(bucket)
+	if err != nil {
+		return err
+	}
 	bucketPath := filepath.Join(fc.path, bucket)
 	return os.RemoveAll(bucketPath)
 }
 
 // Delete deletes an item
+// During a layout migration (see SetPreviousLayout), the file is deleted from both the current and the previous layout.
 func (fc *FileCache) Delete(bucket, key string) error {
-	fc.Lock()
-	defer fc.Unlock()
+	fc.RLock()
+	defer fc.RUnlock()
 
-	// Delete subDirs
-	subDirs, err := fc.subDirs(bucket, key, DirLength, false)
-	if err != nil {
+	if fc.previous == nil {
+		return fc.delete(fc.layout, bucket, key)
+	}
+	err := fc.delete(fc.layout, bucket, key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	previousErr := fc.delete(fc.previous, bucket, key)
+	if previousErr != nil && !os.IsNotExist(previousErr) {
+		return previousErr
+	}
+	// Only return a not exist error if the file did not exist in either layout
+	if err != nil && previousErr != nil {
 		return err
 	}
+	return nil
+}
 
-	// Delete file
-	fullPath := filepath.Join(subDirs[len(subDirs)-1], key)
+// delete deletes the file for a bucket and key in a layout, and any empty subdirs
+func (fc *FileCache) delete(layout Layout, bucket, key string) error {
+	fullPath, err := fc.filePath(layout, bucket, key, false)
+	if err != nil {
+		return err
+	}
 	err = os.Remove(fullPath)
 	if err != nil {
 		return err
 	}
+	return fc.removeEmptySubDirs(layout, bucket, key)
+}
 
-	// Delete empty subdirs
+// removeEmptySubDirs removes the subdirs of the file for a bucket and key in a layout if they are empty.
+// Subdirs can be shared by other keys, so a subdir that is removed or filled concurrently is skipped.
+func (fc *FileCache) removeEmptySubDirs(layout Layout, bucket, key string) error {
+	subDirs, _, err := fc.subDirs(layout, bucket, key, false)
+	if err != nil {
+		return err
+	}
 	for i := len(subDirs)-1; i >= 0; i-- {
 		d := subDirs[i]
 		isEmpty, err := dirIsEmpty(d)
 		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 			return err
 		}
-		if isEmpty {
-			err = os.Remove(d)
-			if err != nil {
-				return err
+		if !isEmpty {
+			return nil
+		}
+		err = os.Remove(d)
+		if err != nil && !os.IsNotExist(err) {
+			// Another file may have been created in the subdir
+			isEmpty, emptyErr := dirIsEmpty(d)
+			if emptyErr == nil && !isEmpty {
+				return nil
 			}
+			return err
 		}
 	}
 	return nil
 }
+
+// dirRemoved returns true if the directory of a file path does not exist
+func dirRemoved(fullPath string) bool {
+	_, err := os.Stat(filepath.Dir(fullPath))
+	return os.IsNotExist(err)
+}
@@ -9,51 +9,86 @@ import (
 )
 
 // FilePath gets the file path of the cached file, and creates the required subfolders if necessary
+// During a layout migration (see SetPreviousLayout), the path of an existing file in the previous layout is returned
+// if the file has not been moved yet, unless makeDir is true.
 func (fc *FileCache) FilePath(bucket, key string, makeDir bool) (filePath string, err error) {
-	fc.Lock()
-	defer fc.Unlock()
+	fc.RLock()
+	defer fc.RUnlock()
 
-	subDirs, err := fc.subDirs(bucket, key, DirLength, true)
+	fullPath, err := fc.filePath(fc.layout, bucket, key, makeDir)
+	if err != nil || makeDir || fc.previous == nil {
+		return fullPath, err
+	}
+	_, err = os.Stat(fullPath)
+	if !os.IsNotExist(err) {
+		return fullPath, nil
+	}
+	previousPath, err := fc.filePath(fc.previous, bucket, key, false)
 	if err != nil {
-		return "", err
+		return fullPath, nil
+	}
+	_, err = os.Stat(previousPath)
+	if err == nil {
+		return previousPath, nil
 	}
-	fullPath := filepath.Join(subDirs[len(subDirs)-1], key)
 	return fullPath, nil
 }
 
-func (fc *FileCache) subDirs(bucket, key string, chunkSize int, makeDirs bool) (subDirs []string, err error) {
-	baseDir := filepath.Ext(key) 
-	baseName := strings.TrimSuffix(key, baseDir)
-	if baseDir == "" {
-		baseDir = "other"
+func (fc *FileCache) filePath(layout Layout, bucket, key string, makeDir bool) (filePath string, err error) {
+	subDirs, name, err := fc.subDirs(layout, bucket, key, makeDir)
+	if err != nil {
+		return "", err
+	}
+	if len(subDirs) == 0 {
+		return filepath.Join(fc.path, bucket, name), nil
+	}
+	return filepath.Join(subDirs[len(subDirs)-1], name), nil
+}
+
+// ValidBucket returns an error if a bucket name cannot be used as a directory name within the file cache
+func ValidBucket(bucket string) error {
+	if !validName(bucket) || strings.ContainsRune(bucket, '\\') {
+		return fmt.Errorf("file cache error: invalid bucket name: %q", bucket)
 	}
-	baseDir = strings.TrimPrefix(baseDir, ".")
-	
+	return nil
+}
+
+// subDirs returns the subdirs of the file for a bucket and key in a layout, and the file name
+func (fc *FileCache) subDirs(layout Layout, bucket, key string, makeDirs bool) (subDirs []string, name string, err error) {
+	err = ValidBucket(bucket)
+	if err != nil {
+		return nil, "", err
+	}
+	dirs, name, err := layout.Path(bucket, key)
+	if err != nil {
+		return nil, "", err
+	}
+
 	// Get bucket dir
 	currentPath := filepath.Join(fc.path, bucket)
 	if makeDirs {
 		err = fc.makeBucketDir(bucket)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 	}
 
 	// Get subdirs, and create subdirs if required
 	subDirs = []string{}
-	for _, d := range append([]string{baseDir}, stringChunks(baseName, chunkSize)...) {
+	for _, d := range dirs {
 		currentPath = filepath.Join(currentPath, d)
 		if makeDirs {
 			_, err = os.Stat(currentPath)
 			if err != nil {
 				if !os.IsNotExist(err) {
-					return nil, err
+					return nil, "", err
 				} 
 				os.Mkdir(currentPath, fc.dirMode)
 			}
 		}
 		subDirs = append(subDirs, currentPath)
 	}
-	return subDirs, nil
+	return subDirs, name, nil
 }
 
 func (fc *FileCache) makeBucketDir(bucket string) error {
@@ -3,18 +3,26 @@ package filecache
 import (
 	"sync"
 	"os"
+	"path/filepath"
 )
 
 const (
 	FileMode = 0644
 	DirLength = 4
+
+	// maxDirRetries is the number of times a file is retried if its subdirs are removed by a concurrent delete
+	maxDirRetries = 3
 )
 
 // FileCache is the FileCache struct
+// The lock only protects the layouts, so files with different keys can be created and deleted concurrently.
+// Callers must not create, move or delete the same key concurrently.
 type FileCache struct {
 	sync.RWMutex
 	path   		string
 	dirMode    	os.FileMode
+	layout 		Layout
+	previous 	Layout
 }
 
 // Init initiates the FileCache
@@ -27,5 +35,114 @@ func Init(path string, dirMode os.FileMode) (fc FileCache, err error) {
 		//mu: nil,
 		path: path,
 		dirMode: dirMode,
+		layout: ChunkedLayout{ChunkSize: DirLength},
 	}, nil
 }
+
+// Layout returns the name of the directory layout of the file cache
+func (fc *FileCache) Layout() string {
+	fc.RLock()
+	defer fc.RUnlock()
+
+	return fc.layout.Name()
+}
+
+// SetLayout sets the directory layout of the file cache (i.e. LayoutLegacy, LayoutFlat or LayoutHashed).
+// Note that existing files are not moved (see SetPreviousLayout and Move).
+func (fc *FileCache) SetLayout(layout string) error {
+	l, err := NewLayout(layout)
+	if err != nil {
+		return err
+	}
+
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.layout = l
+	return nil
+}
+
+// PreviousLayout returns the name of the layout that files are being moved from, or an empty string if files are not being moved
+func (fc *FileCache) PreviousLayout() string {
+	fc.RLock()
+	defer fc.RUnlock()
+
+	if fc.previous == nil {
+		return ""
+	}
+	return fc.previous.Name()
+}
+
+// SetPreviousLayout sets the layout that files are being moved from.  Files that have not been moved yet are found
+// in the previous layout, and can be moved to the current layout using Move.  Use an empty string when all files have been moved.
+func (fc *FileCache) SetPreviousLayout(layout string) error {
+	var l Layout
+	if layout != "" {
+		var err error
+		l, err = NewLayout(layout)
+		if err != nil {
+			return err
+		}
+	}
+
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.previous = l
+	return nil
+}
+
+// Move moves the file for a bucket and key from the previous layout to the current layout.
+// If the file already exists in the current layout, the file in the previous layout is removed.
+// Moved returns false if there is no previous layout, or if the file does not exist in the previous layout.
+func (fc *FileCache) Move(bucket, key string) (moved bool, err error) {
+	fc.RLock()
+	defer fc.RUnlock()
+
+	if fc.previous == nil {
+		return false, nil
+	}
+	previousPath, err := fc.filePath(fc.previous, bucket, key, false)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(previousPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	var fullPath string
+	for attempt := 0; ; attempt++ {
+		fullPath, err = fc.filePath(fc.layout, bucket, key, true)
+		if err != nil {
+			return false, err
+		}
+		if fullPath == previousPath {
+			return false, nil
+		}
+		_, err = os.Stat(fullPath)
+		switch {
+		case err == nil:
+			// The file was replaced after the migration started
+			return false, fc.delete(fc.previous, bucket, key)
+		case !os.IsNotExist(err):
+			return false, err
+		}
+		err = os.Rename(previousPath, fullPath)
+		if err != nil {
+			// Retry if the subdirs were removed by a concurrent delete
+			if attempt < maxDirRetries && dirRemoved(fullPath) {
+				continue
+			}
+			return false, err
+		}
+		break
+	}
+	err = syncDir(filepath.Dir(fullPath))
+	if err != nil {
+		return false, err
+	}
+	return true, fc.removeEmptySubDirs(fc.previous, bucket, key)
+}
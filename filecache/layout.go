@@ -0,0 +1,148 @@
+package filecache
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+const (
+	// LayoutLegacy stores each file at bucket/extension/chunks of the key name/key.  Keys must be valid file names.
+	LayoutLegacy = "legacy"
+	// LayoutFlat stores each file at bucket/escaped key.  Keys must be short enough to be file names once escaped.
+	LayoutFlat = "flat"
+	// LayoutHashed stores each file at bucket/aa/bb/hash, where hash is the SHA-256 hash of the key (see cacheitem.KeyHash).
+	// Any key can be used, and the key is only stored in the database.
+	LayoutHashed = "hashed"
+
+	// maxNameLength is the maximum file name length on most filesystems (NAME_MAX)
+	maxNameLength = 255
+)
+
+// Layout maps keys to file paths within a bucket directory
+type Layout interface {
+	// Name returns the name of the layout, which is recorded in the cache metadata
+	Name() string
+	// Path returns the subdirs (relative to the bucket directory) and the file name of the file for a key
+	Path(bucket, key string) (dirs []string, name string, err error)
+	// Key returns the key of a file name.  If the key cannot be derived from the file name,
+	// the key is empty and keyHash is the hash of the key (see cacheitem.KeyHash).
+	Key(bucket, name string) (key, keyHash string)
+}
+
+// NewLayout returns the layout with the provided name (i.e. LayoutLegacy, LayoutFlat or LayoutHashed)
+func NewLayout(name string) (Layout, error) {
+	switch name {
+	case LayoutLegacy:
+		return ChunkedLayout{ChunkSize: DirLength}, nil
+	case LayoutFlat:
+		return FlatLayout{}, nil
+	case LayoutHashed:
+		return HashFanoutLayout{}, nil
+	default:
+		return nil, fmt.Errorf("file cache error: layout not implemented: %s", name)
+	}
+}
+
+// ChunkedLayout is the legacy layout.  Each file is stored in a directory named after the key extension,
+// then in nested directories named after ChunkSize chunks of the key without the extension.
+type ChunkedLayout struct {
+	ChunkSize int
+}
+
+// Name implements Layout
+func (l ChunkedLayout) Name() string {
+	return LayoutLegacy
+}
+
+// Path implements Layout
+func (l ChunkedLayout) Path(bucket, key string) (dirs []string, name string, err error) {
+	if !validName(key) || strings.ContainsRune(key, '\\') {
+		return nil, "", fmt.Errorf("file cache error: key cannot be used with the %s layout: %q", l.Name(), key)
+	}
+	baseDir := filepath.Ext(key)
+	baseName := strings.TrimSuffix(key, baseDir)
+	if baseDir == "" {
+		baseDir = "other"
+	}
+	baseDir = strings.TrimPrefix(baseDir, ".")
+	dirs = append([]string{baseDir}, stringChunks(baseName, l.ChunkSize)...)
+	for _, d := range dirs {
+		if d == "." || d == ".." {
+			return nil, "", fmt.Errorf("file cache error: key cannot be used with the %s layout: %q", l.Name(), key)
+		}
+	}
+	return dirs, key, nil
+}
+
+// Key implements Layout
+func (l ChunkedLayout) Key(bucket, name string) (key, keyHash string) {
+	return name, ""
+}
+
+// FlatLayout stores each file directly in the bucket directory.  Keys are escaped so that they are valid file names.
+type FlatLayout struct{}
+
+// Name implements Layout
+func (l FlatLayout) Name() string {
+	return LayoutFlat
+}
+
+// Path implements Layout
+func (l FlatLayout) Path(bucket, key string) (dirs []string, name string, err error) {
+	name = url.PathEscape(key)
+	// Escape leading dots, so that keys cannot be "." or "..", or look like temporary files
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	if key == "" || len(name) > maxNameLength || strings.ContainsRune(name, '\\') {
+		return nil, "", fmt.Errorf("file cache error: key cannot be used with the %s layout: %q", l.Name(), key)
+	}
+	return nil, name, nil
+}
+
+// Key implements Layout
+func (l FlatLayout) Key(bucket, name string) (key, keyHash string) {
+	key, err := url.PathUnescape(name)
+	if err != nil {
+		return "", ""
+	}
+	return key, ""
+}
+
+// HashFanoutLayout stores each file at aa/bb/hash, where hash is the SHA-256 hash of the key.
+// The keys in internal buckets (i.e. buckets that start with ".") are already hashes, so they are not hashed again.
+type HashFanoutLayout struct{}
+
+// Name implements Layout
+func (l HashFanoutLayout) Name() string {
+	return LayoutHashed
+}
+
+// Path implements Layout
+func (l HashFanoutLayout) Path(bucket, key string) (dirs []string, name string, err error) {
+	name = cacheitem.KeyHash(key)
+	if strings.HasPrefix(bucket, ".") {
+		if len(key) < 4 || !validName(key) || strings.ContainsAny(key, ".\\") {
+			return nil, "", fmt.Errorf("file cache error: invalid key for bucket %s: %q", bucket, key)
+		}
+		name = key
+	}
+	return []string{name[0:2], name[2:4]}, name, nil
+}
+
+// Key implements Layout
+func (l HashFanoutLayout) Key(bucket, name string) (key, keyHash string) {
+	if strings.HasPrefix(bucket, ".") {
+		return name, ""
+	}
+	return "", name
+}
+
+// validName returns true if s can be used as a file name
+func validName(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\x00") && len(s) <= maxNameLength
+}
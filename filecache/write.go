@@ -1,44 +1,30 @@
 package filecache
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/imclaren/fs"
 )
 
+const (
+	// tempSuffix is added to the names of temporary files while they are being written
+	tempSuffix = ".tmp"
+)
+
 // WriteBytesToFile writes the contents of []byte to a file at filepath.
 // Use WriteReaderToFile instead to avoid holding the bytes in memory
 func (fc *FileCache) WriteBytesToFile(fullPath string, b []byte) error {
 	fc.Lock()
 	defer fc.Unlock()
 
-	fullPath, err := fs.RealPath(fullPath)
-	if err != nil {
-		return fmt.Errorf("cache RealPath error: %s %v", fullPath, err)
-	}
-	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode)
-	if err != nil {
-		return fmt.Errorf("cache OpenFile error: %s %v", fullPath, err)
-	}
-	defer file.Close()
-	n, err := file.Write(b)
-	if err != nil {
-		return err
-	}
-	if n < len(b) {
-		return io.ErrShortWrite
-	}
-	err = file.Sync()
-	if err != nil {
-		return fmt.Errorf("cache file.Sync error: %s %v", fullPath, err)
-	}
-	err = file.Close()
-	if err != nil {
-		return fmt.Errorf("cache file.Close error: %s %v", fullPath, err)
-	}
-	return nil
+	_, err := writeFile(fullPath, bytes.NewReader(b), int64(len(b)))
+	return err
 }
 
 // WriteReaderToFile streams the contents of an io.Reader to a file at filepath
@@ -46,31 +32,74 @@ func (fc *FileCache) WriteReaderToFile(fullPath string, r io.Reader, size int64)
 	fc.Lock()
 	defer fc.Unlock()
 
-	fullPath, err := fs.RealPath(fullPath)
+	_, err := writeFile(fullPath, r, size)
+	return err
+}
+
+// writeFile streams the contents of an io.Reader to a temporary file in the same directory as filepath,
+// syncs the temporary file, renames it to filepath and then syncs the directory.
+// Any existing file at filepath is replaced atomically, and is left unchanged if the write fails.
+func writeFile(fullPath string, r io.Reader, size int64) (n int64, err error) {
+	fullPath, err = fs.RealPath(fullPath)
+	if err != nil {
+		return 0, fmt.Errorf("cache RealPath error: %s %v", fullPath, err)
+	}
+	dir := filepath.Dir(fullPath)
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(fullPath)+tempSuffix)
 	if err != nil {
-		return fmt.Errorf("cache RealPath error: %s %v", fullPath, err)
+		return 0, fmt.Errorf("cache TempFile error: %s %v", fullPath, err)
 	}
-	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode)
+	tempPath := file.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			file.Close()
+			os.Remove(tempPath)
+		}
+	}()
+	n, err = io.Copy(file, r)
 	if err != nil {
-		return fmt.Errorf("cache OpenFile error: %s %v", fullPath, err)
+		return n, err
 	}
-	defer file.Close()
-    n, err := io.Copy(file, r)
-    if err != nil {
-    	return err
-    }
 	if n < size {
-		return io.ErrShortWrite
+		return n, io.ErrShortWrite
+	}
+	err = file.Chmod(FileMode)
+	if err != nil {
+		return n, fmt.Errorf("cache file.Chmod error: %s %v", tempPath, err)
 	}
 	err = file.Sync()
 	if err != nil {
-		return fmt.Errorf("cache file.Sync error: %s %v", fullPath, err)
+		return n, fmt.Errorf("cache file.Sync error: %s %v", tempPath, err)
 	}
 	err = file.Close()
 	if err != nil {
-		return fmt.Errorf("cache file.Close error: %s %v", fullPath, err)
+		return n, fmt.Errorf("cache file.Close error: %s %v", tempPath, err)
+	}
+	err = os.Rename(tempPath, fullPath)
+	if err != nil {
+		return n, fmt.Errorf("cache Rename error: %s %v", fullPath, err)
 	}
-	return nil
+	renamed = true
+	return n, syncDir(dir)
 }
 
+// syncDir syncs a directory so that renames and removals within the directory are persisted
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cache open dir error: %s %v", dir, err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("cache dir.Sync error: %s %v", dir, err)
+	}
+	return d.Close()
+}
 
+// IsTempFile returns true if the file name is the name of a temporary file that is used while writing to the cache.
+// Temporary files that remain after a crash can be safely deleted.
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempSuffix)
+}
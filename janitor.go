@@ -0,0 +1,82 @@
+package calmcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// startJanitor starts the janitor goroutine if a janitor interval has been set.
+// The janitor stops when the cache context is cancelled.  Note that the cache must be locked by the caller, unless the cache
+// has not yet been returned by OpenWithOptions.
+func (c *Cache) startJanitor() {
+	if c.opts.JanitorInterval <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	c.janitorDone = done
+	go c.janitor(c.ctx, c.opts.JanitorInterval, done)
+}
+
+// stopJanitor cancels the cache context and waits for the janitor goroutine to finish.
+// The janitor is waited for without the cache lock, because the janitor locks the cache.
+// StopJanitor does not wait if the janitor has already been stopped (e.g. by an earlier Close).
+func (c *Cache) stopJanitor() {
+	c.Lock()
+	cancel := c.cancel
+	done := c.janitorDone
+	c.janitorDone = nil
+	c.Unlock()
+
+	cancel()
+	if done != nil {
+		<-done
+	}
+}
+
+func (c *Cache) janitor(ctx context.Context, interval time.Duration, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.janitorRun(ctx)
+		}
+	}
+}
+
+// janitorRun deletes expired items and prunes the configured buckets
+func (c *Cache) janitorRun(ctx context.Context) {
+	_, err := c.DeleteExpired()
+	c.janitorError(err)
+	for bucket, d := range c.opts.BucketMaxAges {
+		if ctx.Err() != nil {
+			return
+		}
+		c.janitorError(c.PruneOlderThanContext(ctx, bucket, d))
+	}
+	for bucket, targetSize := range c.opts.BucketTargetSizes {
+		if ctx.Err() != nil {
+			return
+		}
+		if c.opts.PruneStoredSizes {
+			c.janitorError(c.PruneToStoredSizeContext(ctx, bucket, targetSize))
+			continue
+		}
+		c.janitorError(c.PruneToSizeContext(ctx, bucket, targetSize))
+	}
+}
+
+// janitorError reports an error to the JanitorErrorHandler.  Errors caused by stopping the janitor are not reported.
+func (c *Cache) janitorError(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil && c.opts.JanitorErrorHandler != nil {
+		c.opts.JanitorErrorHandler(err)
+	}
+}
@@ -0,0 +1,192 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imclaren/calmcache/cacheitem"
+	"github.com/imclaren/calmcache/filecache"
+)
+
+const (
+	// layoutPageSize is the number of database items that are loaded at a time by MigrateLayout
+	layoutPageSize = 1000
+)
+
+// Layout returns the directory layout of the file cache (i.e. filecache.LayoutLegacy, filecache.LayoutFlat or filecache.LayoutHashed)
+// Layout returns an empty string if the cache does not use a file cache.
+func (c *Cache) Layout() string {
+	if c.FC == nil {
+		return ""
+	}
+	return c.FC.Layout()
+}
+
+// MigrateLayout moves the files in the file cache to a new directory layout (i.e. filecache.LayoutLegacy, filecache.LayoutFlat
+// or filecache.LayoutHashed), and returns the number of files that were moved.  The cache can be used during the migration:
+// new files are written using the new layout, and files that have not been moved yet are found in the previous layout.
+// The cache is only locked while each file is moved.  If the migration is interrupted, the cache keeps using both layouts
+// until MigrateLayout is called again with the same layout.  Note that Check cannot be used during a migration.
+// MigrateLayout returns an error before any files are moved if the key of any item cannot be used with the new layout.
+func (c *Cache) MigrateLayout(ctx context.Context, layout string) (moved int, err error) {
+	if c.FC == nil {
+		return 0, fmt.Errorf("cache MigrateLayout error: the blob store is not a file cache")
+	}
+	l, err := filecache.NewLayout(layout)
+	if err != nil {
+		return 0, err
+	}
+	err = c.checkLayoutKeys(ctx, l)
+	if err != nil {
+		return 0, err
+	}
+	err = c.startLayoutMigration(layout)
+	if err != nil {
+		return 0, err
+	}
+
+	// Move the files for each item
+	lastID := 0
+	for {
+		c.RLock()
+		items, err := c.DB.AllAfterID(lastID, layoutPageSize)
+		c.RUnlock()
+		if err != nil {
+			return moved, err
+		}
+		if len(items) == 0 {
+			break
+		}
+		for _, i := range items {
+			if ctx.Err() != nil {
+				return moved, ctx.Err()
+			}
+			lastID = i.Id
+			OK, err := c.moveFile(i)
+			if err != nil {
+				return moved, err
+			}
+			if OK {
+				moved++
+			}
+		}
+	}
+
+	// Move the deduplicated values
+	lastHash := ""
+	for {
+		c.RLock()
+		blobs, err := c.DB.AllBlobsAfterHash(lastHash, layoutPageSize)
+		c.RUnlock()
+		if err != nil {
+			return moved, err
+		}
+		if len(blobs) == 0 {
+			break
+		}
+		for _, b := range blobs {
+			if ctx.Err() != nil {
+				return moved, ctx.Err()
+			}
+			lastHash = b.Hash
+			c.RLock()
+			unlock := c.lockBlob(b.Hash)
+			OK, err := c.FC.Move(DedupBucket, b.Hash)
+			unlock()
+			c.RUnlock()
+			if err != nil {
+				return moved, err
+			}
+			if OK {
+				moved++
+			}
+		}
+	}
+	return moved, c.finishLayoutMigration()
+}
+
+// checkLayoutKeys returns an error if the key of any item cannot be used with a layout
+func (c *Cache) checkLayoutKeys(ctx context.Context, l filecache.Layout) error {
+	lastID := 0
+	for {
+		c.RLock()
+		items, err := c.DB.AllAfterID(lastID, layoutPageSize)
+		c.RUnlock()
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		for _, i := range items {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastID = i.Id
+			_, _, err = l.Path(i.Bucket, i.Key)
+			if err != nil {
+				return fmt.Errorf("cache MigrateLayout error: %v", err)
+			}
+		}
+	}
+}
+
+// startLayoutMigration records the new layout and the previous layout in the cache metadata, so that an interrupted migration can be resumed
+func (c *Cache) startLayoutMigration(layout string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	current := c.FC.Layout()
+	previous := c.FC.PreviousLayout()
+	if previous != "" {
+		if current != layout {
+			return fmt.Errorf("cache MigrateLayout error: a migration from %s to %s is in progress", previous, current)
+		}
+		return nil
+	}
+	if current == layout {
+		return nil
+	}
+	err := c.DB.SetMeta("previous_layout", current)
+	if err != nil {
+		return err
+	}
+	err = c.DB.SetMeta("layout", layout)
+	if err != nil {
+		return err
+	}
+	err = c.FC.SetPreviousLayout(current)
+	if err != nil {
+		return err
+	}
+	return c.FC.SetLayout(layout)
+}
+
+// moveFile moves the file for an item to the current layout, and sets the item key hash if it is not set
+func (c *Cache) moveFile(i cacheitem.Item) (moved bool, err error) {
+	unlock := c.lockItem(i.Bucket, i.Key)
+	defer unlock()
+
+	if i.KeyHash == "" {
+		err = c.DB.UpdateKeyHash(i.Bucket, i.Key, cacheitem.KeyHash(i.Key))
+		if err != nil {
+			return false, err
+		}
+	}
+	if i.Blob != "" {
+		return false, nil
+	}
+	return c.FC.Move(i.Bucket, i.Key)
+}
+
+// finishLayoutMigration removes the previous layout from the cache metadata
+func (c *Cache) finishLayoutMigration() error {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.DB.DeleteMeta("previous_layout")
+	if err != nil {
+		return err
+	}
+	return c.FC.SetPreviousLayout("")
+}
@@ -0,0 +1,79 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// makeRoom makes room for a put of a value with a stored size of storedSize bytes within Options.MaxSize and Options.MaxItems.
+// Replaced is the item that the put replaces, or nil.  MaxSize limits the total stored size (i.e. the size after compression and encryption).
+// If Options.RejectOverMax is set, or if the value is larger than MaxSize, the error wraps ErrCacheFull.
+// Otherwise, the least recently used items in any bucket are evicted until the put fits.  Pinned items are not evicted.
+// The totals are read from the database stats, so concurrent puts may exceed the limits by the size of the values being put.
+// Note that the item must be locked by the caller (see lockItem).
+func (c *Cache) makeRoom(ctx context.Context, storedSize int64, replaced *cacheitem.Item) error {
+	if c.opts.MaxSize <= 0 && c.opts.MaxItems <= 0 {
+		return nil
+	}
+	if c.opts.MaxSize > 0 && storedSize > c.opts.MaxSize {
+		return fmt.Errorf("%w: item stored size %d is larger than the maximum cache size %d", ErrCacheFull, storedSize, c.opts.MaxSize)
+	}
+	var count int64 = 1
+	if replaced != nil {
+		storedSize -= replaced.StoredSize
+		count = 0
+	}
+	// Items that cannot be evicted are skipped by paging from the last of them in (updated_at, id) order
+	var after cacheitem.Item
+	for {
+		s, err := c.DB.StatsContext(ctx)
+		if err != nil {
+			return err
+		}
+		overSize := c.opts.MaxSize > 0 && s.StoredSize+storedSize > c.opts.MaxSize
+		overItems := c.opts.MaxItems > 0 && s.Count+count > c.opts.MaxItems
+		if !overSize && !overItems {
+			return nil
+		}
+		if c.opts.RejectOverMax {
+			return fmt.Errorf("%w: maximum size %d, maximum items %d", ErrCacheFull, c.opts.MaxSize, c.opts.MaxItems)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		i, err := c.DB.GetOldestAfterContext(ctx, after.UpdatedAt, after.Id)
+		if err != nil {
+			return err
+		}
+		if i == nil {
+			return fmt.Errorf("%w: no items can be evicted", ErrCacheFull)
+		}
+		OK, err := c.evictUnpinned(ctx, i.Bucket, i.Key)
+		if err != nil {
+			return fmt.Errorf("cache evict error: %s %s %w", i.Bucket, i.Key, err)
+		}
+		if !OK {
+			after = *i
+		}
+	}
+}
+
+// evictUnpinned deletes an item from any bucket unless the item or its bucket is locked (e.g. the item is pinned by an open Reader,
+// or the bucket is being pruned).  Deleted returns false if the item or the bucket is locked.
+// Note that the caller may hold the lock of another item, so evictUnpinned does not wait for locks.
+func (c *Cache) evictUnpinned(ctx context.Context, bucket, key string) (deleted bool, err error) {
+	unlockItem, OK := c.items.tryLock(bucket, key)
+	if !OK {
+		return false, nil
+	}
+	defer unlockItem()
+	unlockBucket, OK := c.buckets.tryRLock(bucket, "")
+	if !OK {
+		return false, nil
+	}
+	defer unlockBucket()
+
+	return c.delete(ctx, bucket, key)
+}
@@ -0,0 +1,267 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// Locks are always taken in this order: item lock, then bucket lock, then cache lock.
+// Operations on a single item lock the item, read lock the bucket and read lock the cache (see lockItem and rLockItem),
+// so operations on different items run concurrently.  Operations on a whole bucket (e.g. DeleteBucket and prunes) lock the bucket,
+// and operations on the whole cache (e.g. Check and DeleteExpired) lock the cache.
+// Operations on a page of items (e.g. InvalidateTag) lock the items and then the buckets in name order (see lockItems).
+// Bucket and cache operations must not wait for item locks, so they skip items that are locked (see deleteUnpinned).
+// Deduplicated blobs are locked by hash in DedupBucket after all other locks (see lockBlob), and no other locks are taken while they are held.
+
+// lockShards is the number of shards in a lock table.  Each shard has its own mutex, so that lookups for different names do not contend.
+const lockShards = 64
+
+// lockTable holds a lock for each name (e.g. each item) that is currently locked.
+// Locks are reference counted, and are removed when they are no longer used.  The zero value is ready to use.
+type lockTable struct {
+	shards [lockShards]lockShard
+}
+
+type lockShard struct {
+	sync.Mutex
+	locks map[lockName]*namedLock
+}
+
+type lockName struct {
+	bucket string
+	key    string
+}
+
+type namedLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// shard returns the shard for a name
+func (t *lockTable) shard(name lockName) *lockShard {
+	h := fnv.New32a()
+	h.Write([]byte(name.bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(name.key))
+	return &t.shards[h.Sum32()%lockShards]
+}
+
+// acquire returns the lock for a name, and increments its reference count
+func (t *lockTable) acquire(name lockName) *namedLock {
+	s := t.shard(name)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.locks == nil {
+		s.locks = make(map[lockName]*namedLock)
+	}
+	l, ok := s.locks[name]
+	if !ok {
+		l = &namedLock{}
+		s.locks[name] = l
+	}
+	l.refs++
+	return l
+}
+
+// release decrements the reference count of the lock for a name, and removes the lock when it is no longer used
+func (t *lockTable) release(name lockName, l *namedLock) {
+	s := t.shard(name)
+	s.Lock()
+	defer s.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(s.locks, name)
+	}
+}
+
+// lock locks a name for writing, and returns the function that unlocks it
+func (t *lockTable) lock(bucket, key string) (unlock func()) {
+	name := lockName{bucket, key}
+	l := t.acquire(name)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		t.release(name, l)
+	}
+}
+
+// rLock locks a name for reading, and returns the function that unlocks it
+func (t *lockTable) rLock(bucket, key string) (unlock func()) {
+	name := lockName{bucket, key}
+	l := t.acquire(name)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		t.release(name, l)
+	}
+}
+
+// tryLock locks a name for writing if it is not locked, and returns the function that unlocks it.
+// Use this to lock items while the bucket or the cache is locked (e.g. when pruning).  OK returns false if the name is locked.
+func (t *lockTable) tryLock(bucket, key string) (unlock func(), OK bool) {
+	name := lockName{bucket, key}
+	l := t.acquire(name)
+	if !l.TryLock() {
+		t.release(name, l)
+		return nil, false
+	}
+	return func() {
+		l.Unlock()
+		t.release(name, l)
+	}, true
+}
+
+// tryRLock locks a name for reading if it is not locked for writing, and returns the function that unlocks it.
+// OK returns false if the name is locked for writing.
+func (t *lockTable) tryRLock(bucket, key string) (unlock func(), OK bool) {
+	name := lockName{bucket, key}
+	l := t.acquire(name)
+	if !l.TryRLock() {
+		t.release(name, l)
+		return nil, false
+	}
+	return func() {
+		l.RUnlock()
+		t.release(name, l)
+	}, true
+}
+
+// pathLocks holds the unlock functions of the items that are locked by GetPathAndLock, until GetPathUnlock is called.
+// An item can be locked more than once, so the unlock functions of each item are kept in a slice.
+type pathLocks struct {
+	sync.Mutex
+	unlocks map[lockName][]func()
+}
+
+// push adds the unlock function of an item
+func (p *pathLocks) push(bucket, key string, unlock func()) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.unlocks == nil {
+		p.unlocks = make(map[lockName][]func())
+	}
+	name := lockName{bucket, key}
+	p.unlocks[name] = append(p.unlocks[name], unlock)
+}
+
+// pop removes and returns an unlock function of an item.  OK returns false if the item is not locked.
+func (p *pathLocks) pop(bucket, key string) (unlock func(), OK bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	name := lockName{bucket, key}
+	unlocks := p.unlocks[name]
+	if len(unlocks) == 0 {
+		return nil, false
+	}
+	unlock = unlocks[len(unlocks)-1]
+	if len(unlocks) == 1 {
+		delete(p.unlocks, name)
+	} else {
+		p.unlocks[name] = unlocks[:len(unlocks)-1]
+	}
+	return unlock, true
+}
+
+// lockItem locks an item for writing, then read locks the bucket and the cache, and returns the function that unlocks them
+func (c *Cache) lockItem(bucket, key string) (unlock func()) {
+	unlockItem := c.items.lock(bucket, key)
+	unlockBucket := c.buckets.rLock(bucket, "")
+	c.RLock()
+	return func() {
+		c.RUnlock()
+		unlockBucket()
+		unlockItem()
+	}
+}
+
+// rLockItem read locks an item, the bucket and the cache, and returns the function that unlocks them
+func (c *Cache) rLockItem(bucket, key string) (unlock func()) {
+	unlockItem := c.items.rLock(bucket, key)
+	unlockBucket := c.buckets.rLock(bucket, "")
+	c.RLock()
+	return func() {
+		c.RUnlock()
+		unlockBucket()
+		unlockItem()
+	}
+}
+
+// lockItems locks items for writing, then read locks their buckets and the cache, and returns the function that unlocks them.
+// The items and the buckets are locked in name order, so that operations that lock more than one item do not deadlock.
+func (c *Cache) lockItems(items []cacheitem.Item) (unlock func()) {
+	var names []lockName
+	buckets := map[string]bool{}
+	for _, i := range items {
+		names = append(names, lockName{i.Bucket, i.Key})
+		buckets[i.Bucket] = true
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if names[a].bucket != names[b].bucket {
+			return names[a].bucket < names[b].bucket
+		}
+		return names[a].key < names[b].key
+	})
+	var bucketNames []string
+	for bucket := range buckets {
+		bucketNames = append(bucketNames, bucket)
+	}
+	sort.Strings(bucketNames)
+
+	var unlocks []func()
+	for _, name := range names {
+		unlocks = append(unlocks, c.items.lock(name.bucket, name.key))
+	}
+	for _, bucket := range bucketNames {
+		unlocks = append(unlocks, c.buckets.rLock(bucket, ""))
+	}
+	c.RLock()
+	return func() {
+		c.RUnlock()
+		for n := len(unlocks) - 1; n >= 0; n-- {
+			unlocks[n]()
+		}
+	}
+}
+
+// lockBucket locks a bucket for writing, then read locks the cache, and returns the function that unlocks them
+func (c *Cache) lockBucket(bucket string) (unlock func()) {
+	unlockBucket := c.buckets.lock(bucket, "")
+	c.RLock()
+	return func() {
+		c.RUnlock()
+		unlockBucket()
+	}
+}
+
+// lockBlob locks a deduplicated blob, and returns the function that unlocks it
+func (c *Cache) lockBlob(hash string) (unlock func()) {
+	return c.items.lock(DedupBucket, hash)
+}
+
+// deleteUnpinned deletes an item unless it is locked (e.g. pinned by an open Reader).  Deleted returns false if the item is locked.
+// Note that the bucket or the cache must be locked by the caller.
+func (c *Cache) deleteUnpinned(ctx context.Context, bucket, key string) (deleted bool, err error) {
+	unlock, OK := c.items.tryLock(bucket, key)
+	if !OK {
+		return false, nil
+	}
+	defer unlock()
+
+	OK, err = c.delete(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if !OK {
+		return false, fmt.Errorf("cache delete error: %s %s", bucket, key)
+	}
+	return true, nil
+}
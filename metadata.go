@@ -0,0 +1,103 @@
+package calmcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// PutOptions are the options used to put an item
+type PutOptions struct {
+	// TTL is the time to live of the item.  The item does not expire if TTL is zero.
+	TTL time.Duration
+	// Replace overwrites any existing value for the key.  Otherwise, an existing value is not overwritten.
+	Replace bool
+	// ContentType is the media type of the value (e.g. "text/html").
+	ContentType string
+	// ContentEncoding is the encoding of the value as provided by the caller (e.g. "gzip").
+	// Note that it is stored as metadata only: values are encoded by the cache using BucketCodecs.
+	ContentEncoding string
+	// ETag is the entity tag of the value.  The default is the SHA-256 checksum of the value.
+	ETag string
+	// Metadata holds user key/value pairs
+	Metadata map[string]string
+	// Tags are used to invalidate groups of items across buckets (see InvalidateTag)
+	Tags []string
+}
+
+// setMetadata sets the content type, content encoding, ETag, JSON encoded user metadata and tags of an item
+func (opts PutOptions) setMetadata(i *cacheitem.Item) error {
+	for _, tag := range opts.Tags {
+		if tag == "" {
+			return fmt.Errorf("cache error: empty tag provided")
+		}
+	}
+	i.ContentType = opts.ContentType
+	i.ContentEncoding = opts.ContentEncoding
+	i.ETag = opts.ETag
+	i.Tags = opts.Tags
+	if len(opts.Metadata) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(opts.Metadata)
+	if err != nil {
+		return fmt.Errorf("cache metadata encode error: %v", err)
+	}
+	i.Metadata = string(b)
+	return nil
+}
+
+// PutWithOptions puts the contents of a byte slice in a bucket, with the expiry time and metadata in opts.
+// If the bucket already contains a value for the key and opts.Replace is false, OK returns false and the existing value is not overwritten.
+func (c *Cache) PutWithOptions(bucket, key string, value []byte, opts PutOptions) (OK bool, err error) {
+	return c.PutWithReaderOptionsContext(context.Background(), bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+}
+
+// PutWithReaderOptions puts the contents of an io.Reader in a bucket, with the expiry time and metadata in opts.
+// If the bucket already contains a value for the key and opts.Replace is false, OK returns false and the existing value is not overwritten.
+func (c *Cache) PutWithReaderOptions(bucket, key string, r io.Reader, size int64, opts PutOptions) (OK bool, err error) {
+	return c.PutWithReaderOptionsContext(context.Background(), bucket, key, r, size, opts)
+}
+
+// PutWithReaderOptionsContext is PutWithReaderOptions with a context.  If ctx is done before the value has been stored,
+// reading from r stops and the partial value is removed.
+func (c *Cache) PutWithReaderOptionsContext(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	mode := putIfAbsent
+	if opts.Replace {
+		mode = putReplace
+	}
+	return c.putWithReader(ctx, bucket, key, r, size, opts, mode, 0)
+}
+
+// Stat returns information about an item, including its metadata and tags, without reading the value.
+// If the item does not exist, OK returns false.  Note that Stat does not update the access count or the last accessed time of the item.
+func (c *Cache) Stat(bucket, key string) (OK bool, info ItemInfo, err error) {
+	unlock := c.rLockItem(bucket, key)
+	i, expired, err := c.getItem(context.Background(), bucket, key)
+	if err == nil && i != nil {
+		i.Tags, err = c.DB.GetTags(bucket, key)
+	}
+	unlock()
+	if err != nil {
+		return false, ItemInfo{}, fmt.Errorf("cache Stat error: %s %s %w", bucket, key, err)
+	}
+	if expired {
+		return false, ItemInfo{}, c.deleteExpired(bucket, key)
+	}
+	if i == nil {
+		return false, ItemInfo{}, nil
+	}
+	info, err = newItemInfo(*i)
+	if err != nil {
+		return false, ItemInfo{}, fmt.Errorf("cache Stat error: %s %s %w", bucket, key, err)
+	}
+	return true, info, nil
+}
@@ -0,0 +1,61 @@
+package calmcache
+
+import (
+	"time"
+
+	"github.com/imclaren/calmcache/blobstore"
+)
+
+// Options are the options used to open the cache
+type Options struct {
+	// DBType is the type of the database used to index the cache (i.e. "sqlite" or "postgres").  The default is "sqlite".
+	DBType string
+	// DSN is the database connect string.  The default is a sqlite database in the cache directory.
+	// Use a shared postgres database to allow several hosts to share the same files tree (e.g. on NFS).
+	DSN string
+	// BlobStore stores the cached values.  The default is a file cache in the cache directory.
+	// Note that GetPathAndLock is only supported by file caches.
+	BlobStore blobstore.BlobStore
+	// VerifyChecksums verifies the SHA-256 checksum of each item read by Get and GetToWriter.
+	// Corrupt items are deleted, and ErrCorrupt is returned.  Note that GetToWriter can only detect
+	// corruption after the value has been written, so the caller should discard the written value on error.
+	VerifyChecksums bool
+	// Dedup stores identical values once by SHA-256 content hash, with a reference count in the database.
+	// A deduplicated value is deleted when it is no longer used by any item.  Items that were put before
+	// Dedup was enabled keep their own values.
+	Dedup bool
+	// BucketCodecs maps bucket names to the codec used to encode the values put in the bucket (i.e. codec.Gzip or codec.Zstd).
+	// Values are decoded by Get and GetToWriter.  Items keep the codec that they were put with.
+	BucketCodecs map[string]string
+	// EncryptionKeys maps key IDs to AES keys (16, 24 or 32 bytes long).  Values are encrypted using streaming, chunked AES-GCM.
+	// Keep old keys until RotateKeys has re-encrypted the items that use them.
+	EncryptionKeys map[string][]byte
+	// EncryptionKeyID is the ID of the key in EncryptionKeys that is used to encrypt new values.  Values are not encrypted if it is empty.
+	// Note that encrypted values are not deduplicated, because each encrypted value is different.
+	EncryptionKeyID string
+
+	// MaxSize is the maximum total stored size (in bytes) of the items in all buckets, i.e. the size of the values after they are
+	// compressed and encrypted.  There is no maximum if MaxSize is zero.
+	MaxSize int64
+	// MaxItems is the maximum number of items in all buckets.  There is no maximum if MaxItems is zero.
+	MaxItems int64
+	// RejectOverMax rejects puts that would exceed MaxSize or MaxItems with ErrCacheFull.
+	// Otherwise, the least recently used items in any bucket are evicted to make room for the put.
+	RejectOverMax bool
+
+	// JanitorInterval is the interval between janitor runs.  The janitor is not started if JanitorInterval is zero.
+	// Each janitor run deletes expired items, then prunes the buckets in BucketMaxAges and BucketTargetSizes.
+	JanitorInterval time.Duration
+	// BucketMaxAges maps bucket names to the maximum time since an item was last accessed (see PruneOlderThan)
+	BucketMaxAges map[string]time.Duration
+	// BucketTargetSizes maps bucket names to the target bucket size in bytes (see PruneToSize)
+	BucketTargetSizes map[string]int64
+	// PruneStoredSizes prunes the buckets in BucketTargetSizes to their target stored size (see PruneToStoredSize)
+	PruneStoredSizes bool
+	// EvictionPolicy chooses the items that are deleted first when a bucket is pruned to a target size.  The default is LRU.
+	EvictionPolicy EvictionPolicy
+	// BucketEvictionPolicies maps bucket names to the eviction policy used for the bucket (i.e. LRU, LFU, SizeAware or GreedyDualSize)
+	BucketEvictionPolicies map[string]EvictionPolicy
+	// JanitorErrorHandler is called with any error returned during a janitor run.  Errors are ignored if it is nil.
+	JanitorErrorHandler func(err error)
+}
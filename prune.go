@@ -1,61 +1,140 @@
 package calmcache
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
 
-// PruneToSize prunes the bucket to targetSize (by last accessed time)
+// PruneToSize prunes the bucket to targetSize.  Items are deleted in the order given by the eviction policy of the bucket (by default, last accessed time).
+// Items that are pinned by an open Reader are not pruned.
 func (c *Cache) PruneToSize(bucket string, targetSize int64) error {
-	c.Lock()
-	defer c.Unlock()
+	return c.PruneToSizeContext(context.Background(), bucket, targetSize)
+}
+
+// PruneToSizeContext is PruneToSize with a context.  If ctx is done, pruning stops before the next item is deleted.
+func (c *Cache) PruneToSizeContext(ctx context.Context, bucket string, targetSize int64) error {
+	unlock := c.lockBucket(bucket)
+	defer unlock()
+
+	return c.pruneToSize(ctx, bucket, targetSize, false)
+}
+
+// PruneToStoredSize prunes the bucket to a targetSize of stored bytes, in the order given by the eviction policy of the bucket.
+// The stored size is the size of the encoded (e.g. compressed) values.
+func (c *Cache) PruneToStoredSize(bucket string, targetSize int64) error {
+	return c.PruneToStoredSizeContext(context.Background(), bucket, targetSize)
+}
 
-	bucketSize, err := c.DB.BucketSize(bucket)
+// PruneToStoredSizeContext is PruneToStoredSize with a context.  If ctx is done, pruning stops before the next item is deleted.
+func (c *Cache) PruneToStoredSizeContext(ctx context.Context, bucket string, targetSize int64) error {
+	unlock := c.lockBucket(bucket)
+	defer unlock()
+
+	return c.pruneToSize(ctx, bucket, targetSize, true)
+}
+
+func (c *Cache) pruneToSize(ctx context.Context, bucket string, targetSize int64, stored bool) error {
+	err := c.checkOpen()
+	if err != nil {
+		return err
+	}
+	var bucketSize int64
+	if stored {
+		bucketSize, err = c.DB.BucketStoredSizeContext(ctx, bucket)
+	} else {
+		bucketSize, err = c.DB.BucketSizeContext(ctx, bucket)
+	}
 	if err != nil {
 		return err
 	}
 	if bucketSize == int64(0) || bucketSize <= targetSize {
 		return nil
 	}
+	// Pinned items (e.g. items with an open Reader) are skipped
+	orderBy, args := c.evictionPolicy(bucket).Order(time.Now())
+	skip := 0
 	for bucketSize > targetSize {
-		i, err := c.DB.GetOldestInBucket(bucket)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		i, err := c.DB.GetFirstInBucketSkippingContext(ctx, bucket, orderBy, args, skip)
 		if err != nil {
 			return err
 		}
 		if i == nil {
 			return nil
 		}
-		OK, err := c.delete(i.Bucket, i.Key)
+		OK, err := c.deleteUnpinned(ctx, i.Bucket, i.Key)
 	   	if err != nil {
-	    	return err
+	    	return fmt.Errorf("pruneToSize bucket (%s) delete error for key: %s %w", bucket, i.Key, err)
 	    }
 	    if !OK {
-	    	return fmt.Errorf("pruneToSize bucket (%s) delete error for key: %s", bucket, i.Key)
+	    	skip++
+	    	continue
+	    }
+	    if stored {
+	    	bucketSize = bucketSize-i.StoredSize
+	    } else {
+	    	bucketSize = bucketSize-i.Size
 	    }
-	    bucketSize = bucketSize-i.Size
 	}
 	return nil
 }
 
 // PruneOlderThan prunes the bucket of all items with an access time that is earlier than the time.Duration provided
+// Items that are pinned by an open Reader are not pruned.
 func (c *Cache) PruneOlderThan(bucket string, d time.Duration) error {
-	c.Lock()
-	defer c.Unlock()
+	return c.PruneOlderThanContext(context.Background(), bucket, d)
+}
+
+// PruneOlderThanContext is PruneOlderThan with a context.  If ctx is done, pruning stops before the next item is deleted.
+func (c *Cache) PruneOlderThanContext(ctx context.Context, bucket string, d time.Duration) error {
+	unlock := c.lockBucket(bucket)
+	defer unlock()
 
-	items, err := c.DB.AllInBucketOlderThan(bucket, d)
+	err := c.checkOpen()
+	if err != nil {
+		return err
+	}
+	items, err := c.DB.AllInBucketOlderThanContext(ctx, bucket, d)
 	if err != nil {
 		return err
 	}
 	for _, i := range items {
-		OK, err := c.delete(bucket, i.Key)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, err := c.deleteUnpinned(ctx, bucket, i.Key)
 	   	if err != nil {
-	    	return err
+	    	return fmt.Errorf("PruneOlderThan bucket (%s) error for key: %s %w", bucket, i.Key, err)
 	    }
-	    if !OK {
-	    	return fmt.Errorf("PruneOlderThan bucket (%s) error for key: %s", bucket, i.Key)
-	    }	
 	}
 	return nil
 }
 
+// DeleteExpired deletes all items that have an expiry time that has passed
+// Items that are pinned by an open Reader are not deleted, and are not counted.
+func (c *Cache) DeleteExpired() (count int, err error) {
+	c.Lock()
+	defer c.Unlock()
 
+	err = c.checkOpen()
+	if err != nil {
+		return 0, err
+	}
+	items, err := c.DB.AllExpired()
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range items {
+		OK, err := c.deleteUnpinned(context.Background(), i.Bucket, i.Key)
+		if err != nil {
+			return count, fmt.Errorf("DeleteExpired bucket (%s) error for key: %s %v", i.Bucket, i.Key, err)
+		}
+		if OK {
+			count++
+		}
+	}
+	return count, nil
+}
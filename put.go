@@ -1,56 +1,66 @@
 package calmcache
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"time"
 
 	"github.com/imclaren/calmcache/cacheitem"
+	"github.com/imclaren/calmcache/codec"
 	"github.com/imclaren/calmcache/filecache"
 )
 
+// SizeUnknown is the size to use when putting a value of unknown size.  The value is measured as it is put.
+const SizeUnknown int64 = -1
+
+// putMode controls what happens when a put finds an existing value for a key
+type putMode int
+
+const (
+	// putIfAbsent does not overwrite an existing value
+	putIfAbsent putMode = iota
+	// putReplace always overwrites an existing value
+	putReplace
+	// putCompareAndSwap overwrites an existing value only if it has the expected version
+	putCompareAndSwap
+)
+
 // Put puts the contents of a byte slice in a bucket.
 // Use PutWithFile or PutWithReader instead to avoid holding the bytes in memory
 // If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
 func (c *Cache) Put(bucket, key string, value []byte) (OK bool, err error) {
-	c.Lock()
-	defer c.Unlock()
+	return c.PutContext(context.Background(), bucket, key, value)
+}
 
-	if key == "" {
-		fmt.Errorf("cache error: empty key provided")
-	}
-	i, err := c.DB.GetItem(bucket, key)
-	if err != nil {
-		return false, err
-	}
-	if i != nil {
-		err = c.DB.UpdateAccessCount(bucket, key)
-		if err != nil {
-			return false, err
-		}
-		return false, nil
-	}
-	fullPath, err := c.FC.FilePath(bucket, key, true)
-	if err != nil {
-		return false, err
-	}
-	err = c.FC.WriteBytesToFile(fullPath, value)
-	if err != nil {
-		return false, err
-	}
-	err = c.DB.Insert(cacheitem.New(bucket, key, int64(len(value)), 0, time.Time{}))
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+// PutContext is Put with a context.  If ctx is done before the value has been stored, the put stops and the partial value is removed.
+func (c *Cache) PutContext(ctx context.Context, bucket, key string, value []byte) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	return c.putWithReader(ctx, bucket, key, bytes.NewReader(value), int64(len(value)), PutOptions{}, putIfAbsent, 0)
+}
+
+// PutWithTTL puts the contents of a byte slice in a bucket.  The item expires after the ttl time.Duration.
+// If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
+func (c *Cache) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	return c.putWithReader(context.Background(), bucket, key, bytes.NewReader(value), int64(len(value)), PutOptions{TTL: ttl}, putIfAbsent, 0)
 }
 
 // PutWithFile puts the contents of a file at the provided path in a bucket
 // If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
 func (c *Cache) PutWithFile(bucket, key string, fullPath string) (OK bool, err error) {
-	c.Lock()
-	defer c.Unlock()
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
 
 	file, err := os.OpenFile(fullPath, os.O_RDONLY, filecache.FileMode)
 	if err != nil {
@@ -61,46 +71,374 @@ func (c *Cache) PutWithFile(bucket, key string, fullPath string) (OK bool, err e
 	if err != nil {
 		return false, err
 	}
-	return c.putWithReader(bucket, key, file, fi.Size())
+	return c.putWithReader(context.Background(), bucket, key, file, fi.Size(), PutOptions{}, putIfAbsent, 0)
 }
 
 // PutWithReader puts the contents of an io.Reader in a bucket
 // If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
+// Use SizeUnknown if the size of the value is not known.  Otherwise, if r does not read exactly size bytes,
+// the value is not stored and the error wraps ErrSizeMismatch.
 func (c *Cache) PutWithReader(bucket, key string, r io.Reader, size int64) (OK bool, err error) {
-	c.Lock()
-	defer c.Unlock()
+	return c.PutWithReaderContext(context.Background(), bucket, key, r, size)
+}
 
-	return c.putWithReader(bucket, key, r, size)
+// PutWithReaderContext is PutWithReader with a context.  If ctx is done before the value has been stored,
+// reading from r stops and the partial value is removed.
+func (c *Cache) PutWithReaderContext(ctx context.Context, bucket, key string, r io.Reader, size int64) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	return c.putWithReader(ctx, bucket, key, r, size, PutOptions{}, putIfAbsent, 0)
 }
 
-func (c *Cache) putWithReader(bucket, key string, r io.Reader, size int64) (OK bool, err error) {
+// PutWithReaderTTL puts the contents of an io.Reader in a bucket.  The item expires after the ttl time.Duration.
+// If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
+func (c *Cache) PutWithReaderTTL(bucket, key string, r io.Reader, size int64, ttl time.Duration) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	return c.putWithReader(context.Background(), bucket, key, r, size, PutOptions{TTL: ttl}, putIfAbsent, 0)
+}
+
+// PutIfAbsent puts the contents of a byte slice in a bucket if the bucket does not already contain a value for the key.
+// If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
+func (c *Cache) PutIfAbsent(bucket, key string, value []byte) (OK bool, err error) {
+	return c.Put(bucket, key, value)
+}
+
+// PutIfAbsentWithReader puts the contents of an io.Reader in a bucket if the bucket does not already contain a value for the key.
+// If the bucket already contains a value for the key, OK returns false and the existing value is not overwritten.
+func (c *Cache) PutIfAbsentWithReader(bucket, key string, r io.Reader, size int64) (OK bool, err error) {
+	return c.PutWithReader(bucket, key, r, size)
+}
+
+// Insert puts the contents of a byte slice in a bucket.  If the bucket already contains a value for the key,
+// the existing value is not overwritten and the error wraps ErrExists.  Errors are returned as an ItemError.
+func (c *Cache) Insert(bucket, key string, value []byte) error {
+	return c.InsertWithReader(bucket, key, bytes.NewReader(value), int64(len(value)))
+}
+
+// InsertWithReader puts the contents of an io.Reader in a bucket.  If the bucket already contains a value for the key,
+// the existing value is not overwritten and the error wraps ErrExists.  Errors are returned as an ItemError.
+func (c *Cache) InsertWithReader(bucket, key string, r io.Reader, size int64) error {
+	OK, err := c.PutWithReader(bucket, key, r, size)
+	return insertError(bucket, key, OK, err)
+}
+
+// InsertWithFile puts the contents of a file at the provided path in a bucket.  If the bucket already contains a value for the key,
+// the existing value is not overwritten and the error wraps ErrExists.  Errors are returned as an ItemError.
+func (c *Cache) InsertWithFile(bucket, key string, fullPath string) error {
+	OK, err := c.PutWithFile(bucket, key, fullPath)
+	return insertError(bucket, key, OK, err)
+}
+
+// insertError converts the result of a put to the error returned by the Insert functions
+func insertError(bucket, key string, OK bool, err error) error {
+	if err != nil {
+		return itemError("insert", bucket, key, err)
+	}
+	if !OK {
+		return itemError("insert", bucket, key, ErrExists)
+	}
+	return nil
+}
+
+// Replace puts the contents of a byte slice in a bucket, and overwrites any existing value for the key.
+func (c *Cache) Replace(bucket, key string, value []byte) error {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	_, err := c.putWithReader(context.Background(), bucket, key, bytes.NewReader(value), int64(len(value)), PutOptions{}, putReplace, 0)
+	return err
+}
+
+// ReplaceWithReader puts the contents of an io.Reader in a bucket, and overwrites any existing value for the key.
+func (c *Cache) ReplaceWithReader(bucket, key string, r io.Reader, size int64) error {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	_, err := c.putWithReader(context.Background(), bucket, key, r, size, PutOptions{}, putReplace, 0)
+	return err
+}
+
+// CompareAndSwap puts the contents of a byte slice in a bucket if the current version of the item is equal to version.
+// Use version 0 to put the value only if the bucket does not contain a value for the key.
+// Use Version to get the current version of an item.
+// If the current version does not match, OK returns false and the existing value is not overwritten.
+func (c *Cache) CompareAndSwap(bucket, key string, version int64, value []byte) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	return c.putWithReader(context.Background(), bucket, key, bytes.NewReader(value), int64(len(value)), PutOptions{}, putCompareAndSwap, version)
+}
+
+// CompareAndSwapWithReader puts the contents of an io.Reader in a bucket if the current version of the item is equal to version.
+// Use version 0 to put the value only if the bucket does not contain a value for the key.
+// If the current version does not match, OK returns false and the existing value is not overwritten.
+func (c *Cache) CompareAndSwapWithReader(bucket, key string, version int64, r io.Reader, size int64) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	return c.putWithReader(context.Background(), bucket, key, r, size, PutOptions{}, putCompareAndSwap, version)
+}
+
+// putWithReader puts the contents of an io.Reader in a bucket.  The put mode controls whether an existing value is overwritten.
+// The item expiry time and metadata are set from opts.  The quotas and default TTL of the bucket (see SetBucketConfig) are applied.
+// The put stops if ctx is done before the value has been stored.  Once the value has been stored, the database is updated
+// even if ctx is done, so that the database and the blob store stay consistent.
+// Note that the item must be locked by the caller (see lockItem).
+func (c *Cache) putWithReader(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions, mode putMode, version int64) (OK bool, err error) {
 	if key == "" {
-		return false, fmt.Errorf("cache error: empty key provided")
+		return false, ErrEmptyKey
+	}
+	if size < SizeUnknown {
+		return false, fmt.Errorf("cache error: invalid size: %d", size)
 	}
-	i, err := c.DB.GetItem(bucket, key)
+	err = c.checkOpen()
 	if err != nil {
 		return false, err
 	}
-	if i != nil {
-		err = c.DB.UpdateAccessCount(bucket, key)
+	err = validBucket(bucket)
+	if err != nil {
+		return false, err
+	}
+	i, err := c.DB.GetItemContext(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if i != nil && i.Expired() {
+		_, err = c.delete(ctx, bucket, key)
 		if err != nil {
 			return false, err
 		}
-		return false, nil
+		i = nil
 	}
-	fullPath, err := c.FC.FilePath(bucket, key, true)
+	switch mode {
+	case putIfAbsent:
+		if i != nil {
+			return false, c.DB.UpdateAccessCountContext(ctx, bucket, key)
+		}
+	case putCompareAndSwap:
+		currentVersion := int64(0)
+		if i != nil {
+			currentVersion = i.Version
+		}
+		if currentVersion != version {
+			return false, nil
+		}
+	}
+	cfg, err := c.DB.GetBucketConfigContext(ctx, bucket)
 	if err != nil {
 		return false, err
 	}
-	err = c.FC.WriteReaderToFile(fullPath, r, size)
+	// Reject values that are too large before they are read
+	if size != SizeUnknown {
+		err = checkItemSize(cfg, size)
+		if err != nil {
+			return false, err
+		}
+	}
+	ttl := opts.TTL
+	if ttl == 0 && cfg != nil {
+		ttl = cfg.DefaultTTL
+	}
+	newItem := cacheitem.New(bucket, key, size, 0, cacheitem.ExpiresAt(ttl))
+	err = opts.setMetadata(&newItem)
 	if err != nil {
 		return false, err
 	}
-	err = c.DB.Insert(cacheitem.New(bucket, key, size, 0, time.Time{}))
+	// A replacement of a value that is stored by bucket and key is staged, so that the existing value is kept if the database update fails
+	staged, err := c.storeValue(&newItem, ctxReader{ctx, r}, func(size, storedSize int64) error {
+		err := c.makeBucketRoom(ctx, cfg, size, i)
+		if err != nil {
+			return err
+		}
+		return c.makeRoom(ctx, storedSize, i)
+	}, i != nil && i.Blob == "")
 	if err != nil {
 		return false, err
 	}
+	if i != nil {
+		err = c.DB.Replace(newItem)
+		if err != nil {
+			c.discardValue(staged, newItem)
+			return false, err
+		}
+		err = c.writeStaged(ctx, staged, newItem)
+		if err != nil {
+			return false, err
+		}
+		return true, c.removeReplacedValue(*i, newItem)
+	}
+	err = c.DB.Insert(newItem)
+	if err != nil {
+		// Remove the new value so that it is not orphaned
+		c.removeValue(newItem)
+		return false, err
+	}
 	return true, nil
 }
 
+// storeValue stores the value of a new item, and sets the item size (if it is unknown), checksum, codec, key ID, stored size and blob.
+// Values are compressed, then encrypted.  Values that are encoded, deduplicated or of unknown size are spooled to a temporary file
+// in the cache directory, so that the size, stored size and content hash are known before the value is stored.
+// If the size is known and r does not read exactly that many bytes, the value is not stored and the error wraps ErrSizeMismatch.
+// If reserve is not nil, it is called with the size and the stored size once they are known, and the value is not stored if it returns an error.
+// If stage is true, a value that is stored by bucket and key is always spooled, and is returned as a staged value instead of being stored,
+// so that an existing value is not overwritten until the caller has updated the database (see writeStaged).  Otherwise staged is nil.
+// Note that the item must be locked by the caller (see lockItem).
+func (c *Cache) storeValue(i *cacheitem.Item, r io.Reader, reserve func(size, storedSize int64) error, stage bool) (staged *stagedValue, err error) {
+	r = &sizeReader{r: r, size: i.Size}
+	h := sha256.New()
+	r = io.TeeReader(r, h)
+	i.Codec = c.opts.BucketCodecs[i.Bucket]
+	i.KeyID = c.opts.EncryptionKeyID
+	i.Blob = ""
+	if !i.Encoded() && !c.opts.Dedup && i.Size != SizeUnknown && !stage {
+		if reserve != nil {
+			err := reserve(i.Size, i.Size)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// The blob store replaces an existing value atomically (e.g. the file cache writes to a temporary file and renames it into place)
+		_, err := c.Store.Create(i.Bucket, i.Key, r, i.Size)
+		if err != nil {
+			return nil, err
+		}
+		i.Checksum = hex.EncodeToString(h.Sum(nil))
+		return nil, nil
+	}
+	file, err := ioutil.TempFile(c.Path, ".spool.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("cache spool temp file error: %v", err)
+	}
+	defer func() {
+		// The spool file is kept if it is returned as a staged value
+		if staged == nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	storedHash := sha256.New()
+	var ew io.WriteCloser = nopWriteCloser{io.MultiWriter(file, storedHash)}
+	if i.KeyID != "" {
+		ew, err = codec.NewEncryptWriter(c.opts.EncryptionKeys[i.KeyID], io.MultiWriter(file, storedHash))
+		if err != nil {
+			return nil, err
+		}
+	}
+	w, err := codec.NewWriter(i.Codec, ew)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = ew.Close()
+	if err != nil {
+		return nil, err
+	}
+	i.Size = n
+	i.Checksum = hex.EncodeToString(h.Sum(nil))
+	i.StoredSize, err = file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	if reserve != nil {
+		err = reserve(i.Size, i.StoredSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.opts.Dedup {
+		i.Blob = hex.EncodeToString(storedHash.Sum(nil))
+		return nil, c.createDedupBlob(i.Blob, file, i.StoredSize)
+	}
+	if stage {
+		return &stagedValue{file: file}, nil
+	}
+	_, err = c.Store.Create(i.Bucket, i.Key, file, i.StoredSize)
+	return nil, err
+}
+
+// stagedValue is a spooled value that has not yet been stored (see storeValue)
+type stagedValue struct {
+	file *os.File
+}
+
+// close removes the spool file of a staged value.  Close does nothing if s is nil.
+func (s *stagedValue) close() {
+	if s == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
 
+// writeStaged stores a staged value once the database has been updated to describe it, and removes the spool file.
+// If the value cannot be stored, the item is deleted, because the database no longer describes the existing value.
+// WriteStaged does nothing if staged is nil.  Note that the item must be locked by the caller (see lockItem).
+func (c *Cache) writeStaged(ctx context.Context, staged *stagedValue, i cacheitem.Item) error {
+	if staged == nil {
+		return nil
+	}
+	defer staged.close()
+	_, err := c.Store.Create(i.Bucket, i.Key, staged.file, i.StoredSize)
+	if err != nil {
+		_, deleteErr := c.delete(ctx, i.Bucket, i.Key)
+		return errors.Join(err, deleteErr)
+	}
+	return nil
+}
+
+// discardValue removes the new value of an item that the database could not be updated to describe, so that it is not orphaned.
+// A staged value is removed without being stored.  Otherwise the deduplicated blob is released, or the value stored by bucket
+// and key is removed (i.e. a value that was not staged because the existing value was deduplicated).
+func (c *Cache) discardValue(staged *stagedValue, i cacheitem.Item) {
+	if staged != nil {
+		staged.close()
+		return
+	}
+	c.removeValue(i)
+}
+
+// sizeReader returns an error that wraps ErrSizeMismatch if the wrapped reader does not read exactly size bytes.
+// The error is returned as soon as too many bytes are read, so that the value is not stored.  Sizes are not checked if size is SizeUnknown.
+type sizeReader struct {
+	r    io.Reader
+	size int64
+	n    int64
+}
+
+func (r *sizeReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.n += int64(n)
+	if r.size == SizeUnknown {
+		return n, err
+	}
+	if r.n > r.size {
+		return n, fmt.Errorf("%w: expected %d bytes, read at least %d bytes", ErrSizeMismatch, r.size, r.n)
+	}
+	if err == io.EOF && r.n < r.size {
+		return n, fmt.Errorf("%w: expected %d bytes, read %d bytes", ErrSizeMismatch, r.size, r.n)
+	}
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
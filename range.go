@@ -0,0 +1,105 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// GetRange writes length bytes of the cached item bytes, starting at offset, to w.  Only the requested span is read
+// from the blob store, and the item access stats are updated.  If length is negative or the span extends past the end of the value,
+// the value is written from offset to the end.  If offset is negative or greater than the size of the value, the error wraps ErrInvalidRange.
+// If the item does not exist, OK returns false.  Note that checksums are not verified by range reads, and that the values of
+// encoded (i.e. compressed or encrypted) items must be decoded from the start of the value.
+func (c *Cache) GetRange(bucket, key string, offset, length int64, w io.Writer) (OK bool, err error) {
+	unlock := c.rLockItem(bucket, key)
+	i, expired, err := c.accessItem(context.Background(), bucket, key)
+	if err == nil && i != nil {
+		err = c.copyRange(*i, offset, length, w)
+	}
+	unlock()
+	if expired {
+		return false, c.deleteExpired(bucket, key)
+	}
+	if err != nil {
+		return false, fmt.Errorf("cache GetRange error: %s %s %w", bucket, key, err)
+	}
+	return i != nil, nil
+}
+
+func (c *Cache) copyRange(i cacheitem.Item, offset, length int64, w io.Writer) error {
+	if offset < 0 || offset > i.Size {
+		return ErrInvalidRange
+	}
+	if length < 0 || length > i.Size-offset {
+		length = i.Size - offset
+	}
+	blob, err := c.openBlob(i)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	n, err := io.Copy(w, io.NewSectionReader(blob, offset, length))
+	if err != nil {
+		return err
+	}
+	if n < length {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes of the cached item bytes, starting at off, into p (see io.ReaderAt), and updates the item access stats.
+// If the item does not exist, the error wraps ErrNotFound.  Errors other than io.EOF are returned as an ItemError.
+// Note that checksums are not verified by range reads.
+func (c *Cache) ReadAt(bucket, key string, p []byte, off int64) (n int, err error) {
+	unlock := c.rLockItem(bucket, key)
+	i, expired, err := c.accessItem(context.Background(), bucket, key)
+	if err == nil && i != nil {
+		n, err = c.readAt(*i, p, off)
+	}
+	unlock()
+	if expired {
+		err = c.deleteExpired(bucket, key)
+		if err == nil {
+			err = ErrNotFound
+		}
+	}
+	if err == nil && i == nil {
+		err = ErrNotFound
+	}
+	if err != nil && err != io.EOF {
+		return n, itemError("read", bucket, key, err)
+	}
+	return n, err
+}
+
+func (c *Cache) readAt(i cacheitem.Item, p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrInvalidRange
+	}
+	blob, err := c.openBlob(i)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	return blob.ReadAt(p, off)
+}
+
+// ReaderAt returns an io.ReaderAt for the cached item bytes (e.g. for use with io.NewSectionReader).
+// Each ReadAt call reads the current value of the item (see Cache.ReadAt), so the item is not pinned.  Use GetReader to pin the item.
+func (c *Cache) ReaderAt(bucket, key string) io.ReaderAt {
+	return itemReaderAt{c: c, bucket: bucket, key: key}
+}
+
+type itemReaderAt struct {
+	c      *Cache
+	bucket string
+	key    string
+}
+
+func (r itemReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.c.ReadAt(r.bucket, r.key, p, off)
+}
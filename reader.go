@@ -0,0 +1,252 @@
+package calmcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/imclaren/calmcache/blobstore"
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+// ItemInfo describes a cached item
+type ItemInfo struct {
+	Bucket          string
+	Key             string
+	Size            int64
+	Version         int64
+	Checksum        string
+	AccessCount     int64
+	ExpiresAt       time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	ContentType     string
+	ContentEncoding string
+	// ETag is the entity tag that the item was put with, or the checksum if no entity tag was provided
+	ETag     string
+	Metadata map[string]string
+	// Tags are the tags of the item.  Note that tags are only returned by Stat.
+	Tags []string
+}
+
+func newItemInfo(i cacheitem.Item) (ItemInfo, error) {
+	info := ItemInfo{
+		Bucket:          i.Bucket,
+		Key:             i.Key,
+		Size:            i.Size,
+		Version:         i.Version,
+		Checksum:        i.Checksum,
+		AccessCount:     i.AccessCount,
+		ExpiresAt:       i.ExpiresAt,
+		CreatedAt:       i.CreatedAt,
+		UpdatedAt:       i.UpdatedAt,
+		ContentType:     i.ContentType,
+		ContentEncoding: i.ContentEncoding,
+		ETag:            i.ETag,
+		Tags:            i.Tags,
+	}
+	if info.ETag == "" {
+		info.ETag = i.Checksum
+	}
+	if i.Metadata != "" {
+		err := json.Unmarshal([]byte(i.Metadata), &info.Metadata)
+		if err != nil {
+			return ItemInfo{}, fmt.Errorf("cache metadata decode error: %v", err)
+		}
+	}
+	return info, nil
+}
+
+// Reader reads the value of a cached item.  The item is pinned until the Reader is closed: puts and deletes of the item wait,
+// and prunes skip the item.  Other items can be put and deleted while the Reader is open.
+// Note that DeleteBucket and DeleteCache do not wait for open Readers.
+type Reader struct {
+	blob   blobstore.Blob
+	info   ItemInfo
+	unlock func()
+	once   sync.Once
+	// closeErr is the error returned by the first Close
+	closeErr error
+}
+
+// GetReader gets a Reader for the value of a cached item.  The Reader must be closed.
+// If the item does not exist, OK returns false.  Note that checksums are not verified by Readers.
+func (c *Cache) GetReader(bucket, key string) (OK bool, r *Reader, err error) {
+	unlock := c.items.rLock(bucket, key)
+	unlockBucket := c.buckets.rLock(bucket, "")
+	c.RLock()
+	i, expired, err := c.accessItem(context.Background(), bucket, key)
+	var blob blobstore.Blob
+	if err == nil && i != nil {
+		blob, err = c.openBlob(*i)
+	}
+	c.RUnlock()
+	unlockBucket()
+	if err != nil || i == nil {
+		unlock()
+		if expired {
+			return false, nil, c.deleteExpired(bucket, key)
+		}
+		if err != nil {
+			return false, nil, fmt.Errorf("cache GetReader error: %s %s %v", bucket, key, err)
+		}
+		return false, nil, nil
+	}
+	info, err := newItemInfo(*i)
+	if err != nil {
+		blob.Close()
+		unlock()
+		return false, nil, fmt.Errorf("cache GetReader error: %s %s %v", bucket, key, err)
+	}
+	return true, &Reader{blob: blob, info: info, unlock: unlock}, nil
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(p []byte) (n int, err error) {
+	return r.blob.Read(p)
+}
+
+// ReadAt implements io.ReaderAt
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.blob.ReadAt(p, off)
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	return r.blob.Seek(offset, whence)
+}
+
+// Stat returns information about the item
+func (r *Reader) Stat() ItemInfo {
+	return r.info
+}
+
+// Close closes the Reader and unpins the item.  Closing a Reader again does nothing, and returns the error of the first Close.
+func (r *Reader) Close() error {
+	r.once.Do(func() {
+		r.closeErr = r.blob.Close()
+		r.unlock()
+	})
+	return r.closeErr
+}
+
+// openBlob opens the value of an item as a blob.  Encoded values are decoded.
+func (c *Cache) openBlob(i cacheitem.Item) (blobstore.Blob, error) {
+	if !i.Encoded() {
+		return c.Store.Open(blobLocation(i))
+	}
+	b := &decodedBlob{
+		open: func() (io.ReadCloser, error) { return c.openValue(i) },
+		size: i.Size,
+	}
+	var err error
+	b.r, err = b.open()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// decodedBlob is a blob for an encoded value.  Encoded values cannot be read from an offset, so reads from an earlier
+// offset reopen the value, and the decoded value is discarded up to the offset.
+type decodedBlob struct {
+	sync.Mutex
+	open func() (io.ReadCloser, error)
+	size int64
+	r    io.ReadCloser
+	// rOff is the offset of r, and off is the offset used by Read and Seek
+	rOff int64
+	off  int64
+}
+
+func (b *decodedBlob) Read(p []byte) (n int, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	n, err = b.readAt(p, b.off)
+	b.off += int64(n)
+	return n, err
+}
+
+func (b *decodedBlob) ReadAt(p []byte, off int64) (n int, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	n, err = io.ReadFull(readerFunc(func(p []byte) (int, error) {
+		n, err := b.readAt(p, off)
+		off += int64(n)
+		return n, err
+	}), p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *decodedBlob) readAt(p []byte, off int64) (n int, err error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if b.r == nil || off < b.rOff {
+		if b.r != nil {
+			b.r.Close()
+		}
+		b.r, err = b.open()
+		if err != nil {
+			b.r = nil
+			return 0, err
+		}
+		b.rOff = 0
+	}
+	if off > b.rOff {
+		m, err := io.CopyN(io.Discard, b.r, off-b.rOff)
+		b.rOff += m
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = b.r.Read(p)
+	b.rOff += int64(n)
+	return n, err
+}
+
+func (b *decodedBlob) Seek(offset int64, whence int) (int64, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("cache seek error: invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cache seek error: negative offset: %d", offset)
+	}
+	b.off = offset
+	return offset, nil
+}
+
+func (b *decodedBlob) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.r == nil {
+		return nil
+	}
+	err := b.r.Close()
+	b.r = nil
+	return err
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
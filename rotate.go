@@ -0,0 +1,80 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// rotatePageSize is the number of database items that are loaded at a time by RotateKeys
+	rotatePageSize = 100
+)
+
+// RotateKeys re-encrypts the items that are not encrypted with the current encryption key (see Options.EncryptionKeyID),
+// and returns the number of items that were re-encrypted.  Items are also re-encoded with the current bucket codec.
+// The cache is only locked while each item is re-encrypted, so run RotateKeys in a goroutine to rotate keys in the background.
+// If Options.EncryptionKeyID is empty, encrypted items are decrypted.
+func (c *Cache) RotateKeys(ctx context.Context) (count int, err error) {
+	lastID := 0
+	for {
+		c.RLock()
+		items, err := c.DB.AllNotEncryptedWithKeyAfterID(c.opts.EncryptionKeyID, lastID, rotatePageSize)
+		c.RUnlock()
+		if err != nil {
+			return count, err
+		}
+		if len(items) == 0 {
+			return count, nil
+		}
+		for _, i := range items {
+			if ctx.Err() != nil {
+				return count, ctx.Err()
+			}
+			lastID = i.Id
+			OK, err := c.rotateKey(i.Bucket, i.Key)
+			if err != nil {
+				return count, err
+			}
+			if OK {
+				count++
+			}
+		}
+	}
+}
+
+// rotateKey re-encrypts an item with the current encryption key.  OK returns false if the item no longer needs to be re-encrypted.
+func (c *Cache) rotateKey(bucket, key string) (OK bool, err error) {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	i, err := c.DB.GetItem(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if i == nil || i.Expired() || i.KeyID == c.opts.EncryptionKeyID {
+		return false, nil
+	}
+	r, err := c.openValue(*i)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	newItem := *i
+	staged, err := c.storeValue(&newItem, r, nil, i.Blob == "")
+	if err != nil {
+		return false, fmt.Errorf("cache RotateKeys error: %s %s %v", bucket, key, err)
+	}
+	OK, err = c.DB.UpdateEncoding(newItem)
+	if err == nil && !OK {
+		err = fmt.Errorf("cache RotateKeys error: item changed during rotation: %s %s", bucket, key)
+	}
+	if err != nil {
+		c.discardValue(staged, newItem)
+		return false, err
+	}
+	err = c.writeStaged(context.Background(), staged, newItem)
+	if err != nil {
+		return false, err
+	}
+	return true, c.removeReplacedValue(*i, newItem)
+}
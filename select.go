@@ -1,20 +1,31 @@
 package calmcache
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"io/ioutil"
 
-	"github.com/imclaren/calmcache/filecache"
+	"github.com/imclaren/calmcache/cacheitem"
+	"github.com/imclaren/calmcache/codec"
 )
 
 // Exists checks if an items exists in the cache
+// Expired items do not exist, and are deleted from the cache.
 func (c *Cache) Exists(bucket, key string) (exists bool, err error) {
 	c.RLock()
-	defer c.RUnlock()
-
-	return c.exists(bucket, key)
+	i, expired, err := c.getItem(context.Background(), bucket, key)
+	c.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	if expired {
+		return false, c.deleteExpired(bucket, key)
+	}
+	return i != nil, nil
 }
 
 func (c *Cache) exists(bucket, key string) (exists bool, err error) {
@@ -25,97 +36,364 @@ func (c *Cache) exists(bucket, key string) (exists bool, err error) {
 	return i != nil, err
 }
 
+// Version returns the current version of an item.  The version is incremented each time the item is replaced.
+// If the item does not exist, OK returns false.
+func (c *Cache) Version(bucket, key string) (OK bool, version int64, err error) {
+	c.RLock()
+	i, expired, err := c.getItem(context.Background(), bucket, key)
+	c.RUnlock()
+	if err != nil {
+		return false, 0, err
+	}
+	if expired {
+		return false, 0, c.deleteExpired(bucket, key)
+	}
+	if i == nil {
+		return false, 0, nil
+	}
+	return true, i.Version, nil
+}
+
+// getItem gets a database item.  The item is nil if it does not exist or has expired.
+// If expired is true, the caller should delete the item using deleteExpired after releasing the item and cache locks.
+func (c *Cache) getItem(ctx context.Context, bucket, key string) (i *cacheitem.Item, expired bool, err error) {
+	if key == "" {
+		return nil, false, ErrEmptyKey
+	}
+	err = c.checkOpen()
+	if err != nil {
+		return nil, false, err
+	}
+	i, err = c.DB.GetItemContext(ctx, bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if i != nil && i.Expired() {
+		return nil, true, nil
+	}
+	return i, false, nil
+}
+
+// deleteExpired deletes an item if it has expired.
+// Note that the item and the cache must not be locked by the caller.
+func (c *Cache) deleteExpired(bucket, key string) error {
+	unlock := c.lockItem(bucket, key)
+	defer unlock()
+
+	i, err := c.DB.GetItem(bucket, key)
+	if err != nil {
+		return err
+	}
+	if i == nil || !i.Expired() {
+		return nil
+	}
+	_, err = c.delete(context.Background(), bucket, key)
+	return err
+}
+
 // AllKeys returs the keys for all items in a bucket
+// Expired items are not returned, and are deleted from the cache.
 func (c *Cache) AllKeys(bucket string) (allKeys []string, err error) {
 	c.RLock()
-	defer c.RUnlock()
-
 	allKeys = []string{}
+	expiredKeys := []string{}
+	err = c.checkOpen()
+	if err != nil {
+		c.RUnlock()
+		return nil, err
+	}
 	items, err := c.DB.GetAllInBucket(bucket)
+	c.RUnlock()
 	if err != nil {
 		return nil, err
 	}
 	for _, i := range items {
+		if i.Expired() {
+			expiredKeys = append(expiredKeys, i.Key)
+			continue
+		}
 		allKeys = append(allKeys, i.Key)
 	}
-	return allKeys, err
+	for _, key := range expiredKeys {
+		err = c.deleteExpired(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return allKeys, nil
 }
 
 // Get gets the cached item bytes
-// Use GetPathAndLock / GetPathUnLock or GetToWriter instead to avoid holding the bytes in memory
+// Use GetPathAndLock / GetPathUnlock or GetToWriter instead to avoid holding the bytes in memory
 func (c *Cache) Get(bucket, key string) (value []byte, err error) {
-	c.RLock()
-	defer c.RUnlock()
+	return c.GetContext(context.Background(), bucket, key)
+}
 
-	OK, fullPath, _, err := c.getPath(bucket, key)
+// GetContext is Get with a context.  If ctx is done, reading the value stops and the error of ctx is returned.
+func (c *Cache) GetContext(ctx context.Context, bucket, key string) (value []byte, err error) {
+	_, value, err = c.get(ctx, bucket, key)
+	return value, err
+}
+
+// Lookup gets the cached item bytes.  If the item does not exist, the error wraps ErrNotFound.
+// Errors are returned as an ItemError.
+func (c *Cache) Lookup(bucket, key string) (value []byte, err error) {
+	OK, value, err := c.get(context.Background(), bucket, key)
 	if err != nil {
-		return nil, err
+		return nil, itemError("lookup", bucket, key, err)
 	}
 	if !OK {
-		return nil, nil
+		return nil, itemError("lookup", bucket, key, ErrNotFound)
 	}
-	return ioutil.ReadFile(fullPath)
+	return value, nil
 }
 
-// GetPathAndLock gets the path of the cached file to read.
-// Note that the cache will lock until GetPathUnLock is called
-func (c *Cache) GetPathAndLock(bucket, key string) (OK bool, fullPath string, size int64, err error) {
-	c.RLock()
-	//defer GetPathUnlock()
+// get gets the cached item bytes.  If the item does not exist, OK returns false.
+func (c *Cache) get(ctx context.Context, bucket, key string) (OK bool, value []byte, err error) {
+	unlock := c.rLockItem(bucket, key)
+	i, expired, err := c.accessItem(ctx, bucket, key)
+	if err == nil && i != nil {
+		value, err = c.readAll(ctx, *i)
+	}
+	unlock()
+	if expired {
+		return false, nil, c.deleteExpired(bucket, key)
+	}
+	if errors.Is(err, ErrCorrupt) {
+		return false, nil, errors.Join(err, c.deleteCorrupt(*i))
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return i != nil, value, nil
+}
 
-	OK, fullPath, size, err = c.getPath(bucket, key)
+// readAll reads all of the bytes of an item from the blob store, and verifies the item checksum if required
+func (c *Cache) readAll(ctx context.Context, i cacheitem.Item) (value []byte, err error) {
+	r, err := c.openValue(i)
 	if err != nil {
-		c.GetPathUnlock()
+		return nil, err
 	}
-	return OK, fullPath, size, err
+	defer r.Close()
+	value, err = ioutil.ReadAll(ctxReader{ctx, r})
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.VerifyChecksums {
+		sum := sha256.Sum256(value)
+		err = verifyChecksum(i, sum[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
 }
 
-// GetPathUnlock unlocks the cache.
-// Use this when finished with the item accessed using GetPathAndLock 
-func (c *Cache) GetPathUnlock() {
-	c.RUnlock()
+// openValue opens the value of an item for reading, and decodes the value if it is encoded (i.e. decrypts it, then decompresses it)
+func (c *Cache) openValue(i cacheitem.Item) (io.ReadCloser, error) {
+	var key []byte
+	if i.KeyID != "" {
+		var ok bool
+		key, ok = c.opts.EncryptionKeys[i.KeyID]
+		if !ok {
+			return nil, fmt.Errorf("cache error: unknown encryption key ID (%s) for item: %s %s", i.KeyID, i.Bucket, i.Key)
+		}
+	}
+	blob, err := c.Store.Open(blobLocation(i))
+	if err != nil {
+		return nil, err
+	}
+	if !i.Encoded() {
+		return blob, nil
+	}
+	var r io.Reader = blob
+	if i.KeyID != "" {
+		r, err = codec.NewDecryptReader(key, blob)
+		if err != nil {
+			blob.Close()
+			return nil, err
+		}
+	}
+	cr, err := codec.NewReader(i.Codec, r)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return &decodedValue{ReadCloser: cr, blob: blob}, nil
 }
 
-func (c *Cache) getPath(bucket, key string) (OK bool, fullPath string, size int64, err error) {
-	i, err := c.DB.GetItem(bucket, key)
+// decodedValue is a decoded item value.  Closing it closes both the decoder and the blob.
+type decodedValue struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (v *decodedValue) Close() error {
+	err := v.ReadCloser.Close()
+	blobErr := v.blob.Close()
 	if err != nil {
-		return false, "", 0, err
+		return err
 	}
-	if i == nil {
-		return false, "", 0, nil
+	return blobErr
+}
+
+// verifyChecksum returns a CorruptError if sum does not match the item checksum.  Items without a checksum are not verified.
+func verifyChecksum(i cacheitem.Item, sum []byte) error {
+	if i.Checksum == "" {
+		return nil
+	}
+	actual := hex.EncodeToString(sum)
+	if actual != i.Checksum {
+		return &CorruptError{Bucket: i.Bucket, Key: i.Key, Expected: i.Checksum, Actual: actual}
+	}
+	return nil
+}
+
+// deleteCorrupt deletes a corrupt item, unless it has been replaced since it was read.
+// Note that the item and the cache must not be locked by the caller.
+func (c *Cache) deleteCorrupt(i cacheitem.Item) error {
+	unlock := c.lockItem(i.Bucket, i.Key)
+	defer unlock()
+
+	current, err := c.DB.GetItem(i.Bucket, i.Key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Version != i.Version {
+		return nil
+	}
+	_, err = c.delete(context.Background(), i.Bucket, i.Key)
+	return err
+}
+
+// accessItem gets a database item and updates the item access count.  The item is nil if it does not exist or has expired.
+// If expired is true, the caller should delete the item using deleteExpired after releasing the item and cache locks.
+func (c *Cache) accessItem(ctx context.Context, bucket, key string) (i *cacheitem.Item, expired bool, err error) {
+	i, expired, err = c.getItem(ctx, bucket, key)
+	if err != nil || i == nil {
+		return nil, expired, err
+	}
+	err = c.DB.UpdateAccessCountContext(ctx, bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return i, false, nil
+}
+
+// GetPathAndLock gets the path of the cached file to read.
+// The item is read locked until GetPathUnlock is called with the same bucket and key, so the file is not replaced or deleted
+// until then.  Puts and deletes of the item, and operations on its bucket or the whole cache (e.g. DeleteBucket and Check) wait.
+// If err is nil, GetPathUnlock must be called, even if OK is false.
+// GetPathAndLock returns an error if the cache does not use a file cache, or if the item is encoded (i.e. compressed or encrypted).
+func (c *Cache) GetPathAndLock(bucket, key string) (OK bool, fullPath string, size int64, err error) {
+	unlock := c.rLockItem(bucket, key)
+	OK, expired, fullPath, size, err := c.getPath(context.Background(), bucket, key)
+	if err == nil && expired {
+		unlock()
+		err = c.deleteExpired(bucket, key)
+		unlock = c.rLockItem(bucket, key)
 	}
-	err = c.DB.UpdateAccessCount(bucket, key)
 	if err != nil {
-		return false, "", 0, err
+		unlock()
+		return OK, fullPath, size, err
+	}
+	c.paths.push(bucket, key, unlock)
+	return OK, fullPath, size, nil
+}
+
+// GetPathUnlock unlocks an item that was locked by GetPathAndLock.
+// Use this when finished with the item accessed using GetPathAndLock.  GetPathUnlock does nothing if the item is not locked by GetPathAndLock.
+func (c *Cache) GetPathUnlock(bucket, key string) {
+	unlock, OK := c.paths.pop(bucket, key)
+	if OK {
+		unlock()
 	}
-	fullPath, err = c.FC.FilePath(bucket, key, true)
+}
+
+func (c *Cache) getPath(ctx context.Context, bucket, key string) (OK, expired bool, fullPath string, size int64, err error) {
+	if c.FC == nil {
+		return false, false, "", 0, fmt.Errorf("cache GetPathAndLock error: the blob store is not a file cache")
+	}
+	i, expired, err := c.accessItem(ctx, bucket, key)
+	if err != nil || i == nil {
+		return false, expired, "", 0, err
+	}
+	if i.Encoded() {
+		return false, false, "", 0, fmt.Errorf("cache GetPathAndLock error: the item is encoded: %s %s", bucket, key)
+	}
+	blobBucket, blobKey := blobLocation(*i)
+	fullPath, err = c.FC.FilePath(blobBucket, blobKey, false)
 	if err != nil {
-		return false, "", 0, err
+		return false, false, "", 0, err
 	}
-	return true, fullPath, i.Size, nil
+	return true, false, fullPath, i.Size, nil
 }
 
 // GetToWriter gets the cached item bytes as an io.Writer
+// If checksums are verified and the item is corrupt, ErrCorrupt is returned after the value has been written to w.
 func (c *Cache) GetToWriter(bucket, key string, w io.Writer) (OK bool, err error) {
-	OK, fullPath, size, err := c.GetPathAndLock(bucket, key)
+	return c.GetToWriterContext(context.Background(), bucket, key, w)
+}
+
+// GetToWriterContext is GetToWriter with a context.  If ctx is done, copying the value to w stops and the error of ctx is returned.
+// Note that part of the value may already have been written to w.
+func (c *Cache) GetToWriterContext(ctx context.Context, bucket, key string, w io.Writer) (OK bool, err error) {
+	unlock := c.rLockItem(bucket, key)
+	i, OK, expired, err := c.getToWriter(ctx, bucket, key, w)
+	unlock()
+	if expired {
+		return false, c.deleteExpired(bucket, key)
+	}
+	if errors.Is(err, ErrCorrupt) {
+		err = errors.Join(err, c.deleteCorrupt(*i))
+	}
+	return OK, err
+}
+
+// LookupToWriter writes the cached item bytes to w.  If the item does not exist, the error wraps ErrNotFound.
+// Errors are returned as an ItemError.  If checksums are verified and the item is corrupt, the error wraps ErrCorrupt
+// and the value has already been written to w.
+func (c *Cache) LookupToWriter(bucket, key string, w io.Writer) error {
+	OK, err := c.GetToWriter(bucket, key, w)
 	if err != nil {
-		return false, fmt.Errorf("cache GetToWriter GetPathAndLock error: %s %s %s", bucket, key, err.Error())
+		return itemError("lookup", bucket, key, err)
 	}
-	defer c.GetPathUnlock()
 	if !OK {
-		return false, nil
+		return itemError("lookup", bucket, key, ErrNotFound)
+	}
+	return nil
+}
+
+func (c *Cache) getToWriter(ctx context.Context, bucket, key string, w io.Writer) (i *cacheitem.Item, OK, expired bool, err error) {
+	i, expired, err = c.accessItem(ctx, bucket, key)
+	if err != nil {
+		return nil, false, false, fmt.Errorf("cache GetToWriter GetItem error: %s %s %w", bucket, key, err)
+	}
+	if i == nil {
+		return nil, false, expired, nil
 	}
-	file, err := os.OpenFile(fullPath, os.O_RDONLY, filecache.FileMode)
+	value, err := c.openValue(*i)
 	if err != nil {
-		return false, fmt.Errorf("cache GetToWriter OpenFile error: %s %s %s %v", bucket, key, fullPath, err)
+		return i, false, false, fmt.Errorf("cache GetToWriter Open error: %s %s %v", bucket, key, err)
+	}
+	defer value.Close()
+	var r io.Reader = ctxReader{ctx, value}
+	h := sha256.New()
+	if c.opts.VerifyChecksums {
+		r = io.TeeReader(r, h)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return i, false, false, fmt.Errorf("cache GetToWriter io.Copy error: %s %s %w", bucket, key, err)
+	}
+	if n < i.Size {
+		return i, false, false, io.ErrShortWrite
 	}
-	defer file.Close()
-    n, err := io.Copy(w, file)
-    if err != nil {
-    	return false, fmt.Errorf("cache GetToWriter io.Copy error: %s %s %s", bucket, key, err.Error())
-    }
-	if n < size {
-		return false, io.ErrShortWrite
+	if c.opts.VerifyChecksums {
+		err = verifyChecksum(*i, h.Sum(nil))
+		if err != nil {
+			return i, false, false, err
+		}
 	}
-	return true, nil
+	return i, true, false, nil
 }
@@ -0,0 +1,80 @@
+package calmcache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/imclaren/calmcache/cacheitem"
+)
+
+const (
+	// invalidatePageSize is the number of database items that are loaded at a time by InvalidateTag
+	invalidatePageSize = 100
+)
+
+// InvalidateTag deletes every item with the tag, in all buckets, and returns the number of items that were deleted.
+// Tags are set using PutOptions.Tags.  Items are loaded a page at a time, so the cache can be used while the items are deleted.
+// Note that InvalidateTag waits for open Readers of the tagged items to be closed.
+func (c *Cache) InvalidateTag(tag string) (count int, err error) {
+	return c.InvalidateTagContext(context.Background(), tag)
+}
+
+// InvalidateTagContext is InvalidateTag with a context.  If ctx is done, InvalidateTag stops before the next page of items is deleted.
+func (c *Cache) InvalidateTagContext(ctx context.Context, tag string) (count int, err error) {
+	if tag == "" {
+		return 0, fmt.Errorf("cache error: empty tag provided")
+	}
+	lastID := 0
+	for {
+		c.RLock()
+		err = c.checkOpen()
+		if err != nil {
+			c.RUnlock()
+			return count, err
+		}
+		items, err := c.DB.AllWithTagAfterIDContext(ctx, tag, lastID, invalidatePageSize)
+		c.RUnlock()
+		if err != nil {
+			return count, err
+		}
+		if len(items) == 0 {
+			return count, nil
+		}
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		lastID = items[len(items)-1].Id
+		n, err := c.invalidateTagPage(tag, items)
+		count += n
+		if err != nil {
+			return count, fmt.Errorf("cache InvalidateTag error: %w", err)
+		}
+	}
+}
+
+// invalidateTagPage deletes the items of a page that still have the tag (i.e. items that have not been replaced without it)
+// in one database transaction, removes their values, and returns the number of items that were deleted.
+func (c *Cache) invalidateTagPage(tag string, items []cacheitem.Item) (count int, err error) {
+	unlock := c.lockItems(items)
+	defer unlock()
+
+	err = c.checkOpen()
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for _, i := range items {
+		ids = append(ids, i.Id)
+	}
+	deleted, err := c.DB.DeleteWithTagContext(context.Background(), tag, ids)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range deleted {
+		err = c.removeValue(i)
+		if err != nil {
+			return len(deleted), fmt.Errorf("%s %s %w", i.Bucket, i.Key, err)
+		}
+	}
+	return len(deleted), nil
+}